@@ -0,0 +1,114 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"hash/fnv"
+	"math/rand"
+)
+
+// The load-balancing strategies a client can use to choose which of the peers
+// offering a service receives a request.
+const (
+	// ConsistentHash sends every request with the same key (see KeyHeader) to
+	// the same peer for as long as that peer is available. Requests without a
+	// key are sent round-robin.
+	ConsistentHash = "consistent-hash"
+	// LeastOutstanding sends a request to the peer with the fewest requests from
+	// this client that are still waiting for a response.
+	LeastOutstanding = "least-outstanding"
+	// PowerOfTwo compares two peers chosen at random and sends a request to the
+	// one with fewer outstanding requests.
+	PowerOfTwo = "power-of-two"
+	// Random sends a request to a peer chosen at random.
+	Random = "random"
+	// RoundRobin sends requests to each peer in turn. It is the default.
+	RoundRobin = "round-robin"
+	// Weighted sends a request to a peer chosen at random in proportion to the
+	// weight each peer advertises (see Config.Weight).
+	Weighted = "weighted"
+)
+
+// Requests can override the load-balancing strategy of a client by setting
+// these headers.
+const (
+	// BalancerHeader holds the load-balancing strategy for a single request.
+	BalancerHeader = "X-Sleuth-Balancer"
+	// KeyHeader holds the key a request is hashed by when it is balanced using
+	// the ConsistentHash strategy.
+	KeyHeader = "X-Sleuth-Key"
+)
+
+var strategies = map[string]struct{}{
+	ConsistentHash:   {},
+	LeastOutstanding: {},
+	PowerOfTwo:       {},
+	Random:           {},
+	RoundRobin:       {},
+	Weighted:         {},
+}
+
+// hashed returns the peer with the highest rendezvous hash for key, so that
+// only the requests whose peer leaves are sent elsewhere when peers change.
+func hashed(list []*peer, key string) *peer {
+	var chosen *peer
+	var highest uint64
+	for _, p := range list {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte(p.name))
+		if sum := hash.Sum64(); chosen == nil || sum > highest {
+			chosen, highest = p, sum
+		}
+	}
+	return chosen
+}
+
+// least returns the index of the peer with the lowest load. Ties go to the
+// first peer at or after start so that idle peers take turns.
+func least(list []*peer, start int, load func(string) int) int {
+	chosen, lowest := -1, 0
+	for i := range list {
+		index := (start + i) % len(list)
+		if current := load(list[index].node); chosen < 0 || current < lowest {
+			chosen, lowest = index, current
+		}
+	}
+	return chosen
+}
+
+// twoChoices returns the less loaded of two different peers chosen at random.
+func twoChoices(list []*peer, load func(string) int) *peer {
+	if len(list) == 1 {
+		return list[0]
+	}
+	first := rand.Intn(len(list))
+	second := rand.Intn(len(list) - 1)
+	if second >= first {
+		second++
+	}
+	if load(list[second].node) < load(list[first].node) {
+		return list[second]
+	}
+	return list[first]
+}
+
+// weighted returns a peer chosen at random in proportion to its weight.
+func weighted(list []*peer) *peer {
+	total := 0
+	for _, p := range list {
+		total += p.weight
+	}
+	if total == 0 {
+		return list[rand.Intn(len(list))]
+	}
+	target := rand.Intn(total)
+	for _, p := range list {
+		if target -= p.weight; target < 0 {
+			return p
+		}
+	}
+	return list[len(list)-1]
+}
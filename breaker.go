@@ -0,0 +1,119 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker a client keeps for a peer.
+type BreakerState string
+
+// The states of a circuit breaker.
+const (
+	// BreakerClosed means that the peer receives requests as usual.
+	BreakerClosed BreakerState = "closed"
+	// BreakerHalfOpen means that the peer's cooldown has passed and a single
+	// request is being sent to it to find out whether it has recovered.
+	BreakerHalfOpen BreakerState = "half-open"
+	// BreakerOpen means that the peer has been ejected from rotation until its
+	// cooldown has passed.
+	BreakerOpen BreakerState = "open"
+)
+
+// BreakerPolicy describes when a client stops sending requests to a peer that
+// keeps failing. A request fails if it times out, cannot be sent, or receives
+// a 5xx response.
+type BreakerPolicy struct {
+	// Cooldown is how long a peer is ejected from rotation before a request is
+	// sent to it again. If that request fails, the peer is ejected again.
+	Cooldown time.Duration
+
+	// Failures is the number of consecutive failed requests after which a peer
+	// is ejected from rotation. Values less than 1 are treated as 1.
+	Failures int
+}
+
+// BreakerInfo describes the circuit breaker a client keeps for a peer.
+type BreakerInfo struct {
+	// Failures is the number of consecutive failed requests to the peer.
+	Failures int
+	// Name is the name of the peer.
+	Name string
+	// Service is the service the peer offers.
+	Service string
+	// State is the state of the breaker.
+	State BreakerState
+	// Until is when an open breaker half-opens.
+	Until time.Time
+}
+
+// breaker tracks the consecutive failures of a peer.
+type breaker struct {
+	*sync.Mutex
+	failures int
+	probing  bool
+	state    BreakerState
+	until    time.Time
+}
+
+func (b *breaker) info() (int, BreakerState, time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	return b.failures, b.state, b.until
+}
+
+// record tracks the outcome of a request to the peer.
+func (b *breaker) record(policy *BreakerPolicy, failed bool, now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.state = BreakerClosed
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= policy.Failures {
+		b.state = BreakerOpen
+		b.until = now.Add(policy.Cooldown)
+	}
+}
+
+// release forgets a request that was abandoned before it succeeded or failed.
+func (b *breaker) release() {
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+}
+
+// tryAcquire reports whether a request can be sent to the peer and, if it can,
+// records that it is being sent. If the breaker is not closed, that request is
+// the probe that decides whether it closes, and it is checked for and claimed
+// at once so that concurrent requests cannot all probe the peer.
+func (b *breaker) tryAcquire(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if now.Before(b.until) {
+			return false
+		}
+		b.state = BreakerHalfOpen
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+	default:
+		return true
+	}
+	b.probing = true
+	return true
+}
+
+func newBreaker() *breaker {
+	return &breaker{Mutex: new(sync.Mutex), state: BreakerClosed}
+}
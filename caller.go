@@ -0,0 +1,70 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"context"
+	"net/http"
+)
+
+// The headers that tell a handler which peer sent a request. Headers with
+// these names that a request already has when it arrives are removed, so that
+// a peer cannot pose as another one.
+const (
+	// CallerHeader is the name of the calling peer.
+	CallerHeader = "X-Sleuth-Caller"
+	// CallerNodeHeader is the node identifier of the calling peer.
+	CallerNodeHeader = "X-Sleuth-Caller-Node"
+	// CallerServiceHeader is the service the calling peer offers, if any.
+	CallerServiceHeader = "X-Sleuth-Caller-Service"
+	// CallerVersionHeader is the version of the service the calling peer
+	// offers, if any.
+	CallerVersionHeader = "X-Sleuth-Caller-Version"
+)
+
+// Caller describes the peer that sent a request to a handler, as that peer
+// has announced itself to the network. If the group has a key, a caller has
+// proven that it belongs to the group.
+type Caller struct {
+	// Name is the short public name of the peer.
+	Name string
+	// Node is the identifier of the peer. It is the node of the peer's
+	// PeerInfo for each service the peer offers.
+	Node string
+	// Service is the service the peer offers. It is empty for a peer in
+	// client-only mode. A peer that offers more than one service is described
+	// by the one in its type header, or else the first by name.
+	Service string
+	// Version is the version of Service.
+	Version string
+}
+
+// callerKey is the context key for the Caller of a request.
+type callerKey struct{}
+
+// CallerFrom returns the peer that sent a request to a handler, if the
+// context is that of a request received through sleuth.
+func CallerFrom(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+	return caller, ok
+}
+
+// identify adds the caller of a request to its context and headers.
+func identify(req *http.Request, caller Caller) *http.Request {
+	headers := [...]string{CallerHeader, CallerNodeHeader, CallerServiceHeader,
+		CallerVersionHeader}
+	values := [...]string{caller.Name, caller.Node, caller.Service,
+		caller.Version}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	for i, header := range headers {
+		req.Header.Del(header)
+		if values[i] != "" {
+			req.Header.Set(header, values[i])
+		}
+	}
+	return req.WithContext(context.WithValue(req.Context(), callerKey{}, caller))
+}
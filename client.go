@@ -5,91 +5,316 @@
 package sleuth
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ursiform/logger"
-	"github.com/zeromq/gyre"
 )
 
 type listener struct {
 	*sync.Mutex
-	handles map[string]chan *http.Response
+	handles     map[string]chan *http.Response
+	nodes       map[string]string // map[handle]peer-node
+	outstanding map[string]int    // map[peer-node]requests
+}
+
+// release forgets a handle. The listener must be locked.
+func (l *listener) release(handle string) {
+	if node, ok := l.nodes[handle]; ok {
+		if l.outstanding[node]--; l.outstanding[node] <= 0 {
+			delete(l.outstanding, node)
+		}
+		delete(l.nodes, handle)
+	}
+	delete(l.handles, handle)
+}
+
+// attempt is a request that has been sent to a peer and is waiting for a
+// response.
+type attempt struct {
+	handle   string
+	listener chan *http.Response
+	out      *outbound
+	peer     *peer
+	sent     time.Time
+}
+
+// Requirement is a minimum number of peers offering a service that
+// WaitForQuorum waits for.
+type Requirement struct {
+	// Count is the minimum number of peers. Values less than 1 are treated as 1.
+	Count int
+	// Service is the name of the service.
+	Service string
+	// Version is an optional version constraint that the peers must satisfy
+	// (see VersionHeader).
+	Version string
+}
+
+// requirement is a service that WaitFor is waiting for.
+type requirement struct {
+	count   int
+	service string
+	want    constraint
 }
 
 // Client is the peer on the sleuth network that makes requests and, if a
-// handler has been provided, responds to peer requests.
+// handler has been provided, responds to peer requests. Client implements
+// http.RoundTripper so that it can be used as the Transport of an http.Client
+// or registered with an http.Transport for the sleuth scheme:
+// 	transport.RegisterProtocol("sleuth", client)
 type Client struct {
+	// Breaker is the policy for ejecting peers that keep failing from rotation.
+	// If it is nil, peers are never ejected.
+	Breaker *BreakerPolicy
+
+	// Retry is the policy for re-sending requests that fail because a peer has
+	// timed out or cannot be reached. If it is nil, requests are not retried.
+	Retry *RetryPolicy
+
 	// Timeout is the duration to wait before an outstanding request times out.
-	// By default, it is set to 500ms.
+	// By default, it is set to 500ms. A request whose context is canceled or
+	// reaches its deadline before then is abandoned early. Timeout applies to
+	// the arrival of a response, not to reading a streamed response body.
 	Timeout time.Duration
 
 	additions *notifier
-	closed    bool
+	admission Admission
+	balancer  string
+	balancers map[string]string // map[service-type]strategy
+	closed    int32             // set atomically to 1 by Close
 	group     string
 	handle    int64
-	handler   http.Handler
+	latencies *latencies
+	limiter   *limiter
 	listener  *listener
 	log       *logger.Logger
-	node      *gyre.Gyre
+	node      Transport
+	queue     *queue
+	registry  *registry
+	sealer    *sealer
+	streams   *streams
+	work      *work
 
-	directory map[string]string // map[node-name]service-type
-	services  *pool
+	directory   map[string][]string // map[node-name][]service-type
+	services    *pool
+	subscribers *subscribers
 }
 
-func (c *Client) add(group, name, node, service, version string) error {
+// abandon stops waiting for the response to an attempt and tells the serving
+// peer that the response is no longer wanted.
+func (c *Client) abandon(a *attempt, err *Error) {
+	a.peer.breaker.release()
+	c.unlisten(a.handle)
+	c.streams.cancel(&link{
+		group:  c.group,
+		handle: a.handle,
+		node:   c.node,
+		origin: c.node.UUID(),
+		peer:   a.peer.node,
+	})
+	if a.out != nil {
+		if err == nil {
+			err = newError(errStream, "request was abandoned")
+		}
+		a.out.abort(err)
+	}
+}
+
+// admit decides whether a request from a node to a service is handled. It
+// returns zero if it is, or the status code of the response that rejects it
+// and, if it was rate limited, how long until it would be admitted.
+func (c *Client) admit(node, service string,
+	req *http.Request) (int, time.Duration) {
+	if wait, ok := c.limiter.admit(node, service, time.Now()); !ok {
+		return http.StatusTooManyRequests, wait
+	}
+	if c.admission != nil {
+		if status := c.admission(node, service, req); status != 0 {
+			return status, 0
+		}
+	}
+	return 0, 0
+}
+
+// announce tells every member of the group which services the client offers.
+// The caller must hold the registry lock so that announcements arrive in order.
+func (c *Client) announce() error {
+	c.registry.changed = true
+	payload, err := c.registry.announcement(c.group)
+	if err != nil {
+		return err.(*Error).escalate(errRegister)
+	}
+	for node := range c.registry.members {
+		if err := c.node.Whisper(node, payload); err != nil {
+			c.log.Error(newError(errANNC, err.Error()).escalate(errRegister).Error())
+		}
+	}
+	return nil
+}
+
+// acquire tells the circuit breaker of a peer that a request is being sent, if
+// the breaker lets it be sent.
+func (c *Client) acquire(p *peer) bool {
+	return c.Breaker == nil || p.breaker.tryAcquire(time.Now())
+}
+
+func (c *Client) add(group string, p *peer) error {
 	if group != c.group {
-		c.log.Debug("sleuth: no group header for %s, client-only", name)
+		c.log.Debug("sleuth: no group header for %s, client-only", p.name)
 		return nil
 	}
 	// Node and service are required. Version is optional.
-	if node == "" || service == "" {
+	if p.node == "" || p.service == "" {
 		format := "add failed for name=\"%s\", node=\"%s\", service=\"%s\""
-		return newError(errAdd, format, name, node, service)
+		return newError(errAdd, format, p.name, p.node, p.service)
+	}
+	// Associate the node name with its services in the directory.
+	listed := false
+	for _, service := range c.directory[p.name] {
+		listed = listed || service == p.service
+	}
+	if !listed {
+		c.directory[p.name] = append(c.directory[p.name], p.service)
 	}
-	// Associate the node name with its service in the directory.
-	c.directory[name] = service
 	// Idempotently create a service workers pool.
-	c.services.add(service)
+	created := c.services.add(p.service)
 	// Add peer to the service workers.
-	p := &peer{name: name, node: node, service: service, version: version}
-	c.services.workers[service].add(p)
+	p.breaker = newBreaker()
+	p.seen = time.Now()
+	if p.weight < 1 {
+		p.weight = 1
+	}
+	peers, _ := c.services.get(p.service)
+	peers.add(p)
+	changes := []Change{{Peer: p.info(), Service: p.service, Type: PeerJoined}}
+	if created {
+		changes = append(changes, Change{
+			Peer:    p.info(),
+			Service: p.service,
+			Type:    ServiceAvailable,
+		})
+	}
+	c.subscribers.publish(changes...)
 	c.additions.notify()
-	c.log.Info("sleuth: add %s/%s %s to %s", service, version, name, c.group)
+	c.log.Info("sleuth: add %s/%s %s to %s", p.service, p.version, p.name, c.group)
 	return nil
 }
 
-// Blocks until the required services are available to the client.
-// Returns true if it had to block and false if it returns immediately.
-func (c *Client) block(required map[string]struct{}, services []string) bool {
+// Blocks until the required services are available to the client, the
+// context is done, or the client is closed. Returns true if it had to block
+// and false if it returns immediately. Any number of goroutines can block at
+// the same time.
+func (c *Client) block(ctx context.Context, required map[string]*requirement,
+	services []string) (bool, *Error) {
 	// Even though the client may have just checked to see if services exist,
 	// the check is performed here in case there was a delay waiting for the
 	// additions mutex to become available.
 	if c.has(required) {
-		return false
+		return false, nil
 	}
 	c.log.Blocked("sleuth: waiting for client to find %s", services)
-	c.additions.activate()
-	for range c.additions.stream {
+	for {
+		changed := c.additions.wait()
 		if c.has(required) {
 			break
 		}
+		select {
+		case <-changed:
+		case <-c.additions.done:
+			format := "client closed while waiting for %s"
+			return true, newError(errClosed, format, c.missing(required))
+		case <-ctx.Done():
+			code := errCanceled
+			if ctx.Err() == context.DeadlineExceeded {
+				code = errDeadline
+			}
+			format := "still waiting for %s: %s"
+			err := newError(code, format, c.missing(required), ctx.Err().Error())
+			err.cause = ctx.Err()
+			return true, err
+		}
 	}
-	c.additions.deactivate()
 	c.log.Unblocked("sleuth: client found %s", services)
-	return true
+	return true, nil
+}
+
+// Breakers returns the state of the circuit breaker of every peer offering a
+// service, sorted by service and peer name. Breakers are only used if the
+// client has a Breaker policy.
+func (c *Client) Breakers() []BreakerInfo {
+	var infos []BreakerInfo
+	for _, p := range c.services.peers() {
+		failures, state, until := p.breaker.info()
+		infos = append(infos, BreakerInfo{
+			Failures: failures,
+			Name:     p.name,
+			Service:  p.service,
+			State:    state,
+			Until:    until,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Service != infos[j].Service {
+			return infos[i].Service < infos[j].Service
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
 }
 
-// Close leaves the sleuth network and stops the Gyre node. It can only be
+// challenge asks a node to prove that it belongs to the group by returning a
+// nonce (CHAL command), unless the node has already been asked, and records
+// its enter event if it is given one. Because the nonce is new for each
+// challenge, headers and messages recorded in the past cannot answer it. It
+// returns the enter event of a node that has proven itself and entered.
+func (c *Client) challenge(node string, event *Event) (*Event, error) {
+	c.registry.Lock()
+	defer c.registry.Unlock()
+	if _, ok := c.registry.members[node]; ok {
+		return nil, nil
+	}
+	pending, ok := c.registry.challenges[node]
+	if !ok {
+		nonce, err := c.sealer.nonce()
+		if err != nil {
+			return nil, err
+		}
+		payload := []byte(c.group + chal + nonce)
+		if err := c.node.Whisper(node, payload); err != nil {
+			return nil, newError(errChallenge, err.Error())
+		}
+		pending = &challenge{nonce: nonce}
+		c.registry.challenges[node] = pending
+	}
+	if event != nil {
+		pending.event = event
+	}
+	if !pending.proven || pending.event == nil {
+		return nil, nil
+	}
+	delete(c.registry.challenges, node)
+	return pending.event, nil
+}
+
+// Close leaves the sleuth network and stops the transport. It can only be
 // called once, even if it returns an error the first time it is called.
 func (c *Client) Close() error {
-	defer func(c *Client) { c.closed = true }(c)
-	if c.closed {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
 		return newError(errClosed, "client is already closed")
 	}
 	c.log.Info("%s leaving %s...", c.node.Name(), c.group)
+	c.subscribers.close()
+	c.additions.close()
+	c.queue.close()
 	if err := c.node.Leave(c.group); err != nil {
 		return newError(errLeave, err.Error())
 	}
@@ -99,22 +324,55 @@ func (c *Client) Close() error {
 	return nil
 }
 
-func (c *Client) dispatch(payload []byte) error {
+func (c *Client) dispatch(from string, payload []byte) error {
 	// Returned responses (RECV command) and outstanding requests (REPL command)
 	// have these headers, respectively: SLEUTH-V0RECV and SLEUTH-V0REPL
+	// Chunks of streamed bodies (DATA command) and their flow control (FLOW
+	// command) have these headers: SLEUTH-V0DATA and SLEUTH-V0FLOW
+	// Changes to the services of a peer (ANNC command) have the header:
+	// SLEUTH-V0ANNC
+	// Challenges to prove a peer has the group key (CHAL command) and their
+	// answers (PROV command) have these headers: SLEUTH-V0CHAL and SLEUTH-V0PROV
 	groupLength := len(c.group)
 	dispatchLength := 4
 	headerLength := groupLength + dispatchLength
 	// If the message header does not match the group, bail.
-	if len(payload) < headerLength || string(payload[0:groupLength]) != c.group {
+	if len(payload) < groupLength || string(payload[0:groupLength]) != c.group {
+		return newError(errDispatchHeader, "bad dispatch header")
+	}
+	// If the group has a key, messages are opened before they are read.
+	if c.sealer != nil {
+		opened, err := c.sealer.open(from, c.node.UUID(), payload)
+		if err != nil {
+			return err
+		}
+		payload = opened
+	}
+	if len(payload) < headerLength {
 		return newError(errDispatchHeader, "bad dispatch header")
 	}
 	action := string(payload[groupLength : groupLength+dispatchLength])
+	// Only peers that have proven they belong to the group are heard from,
+	// except for the challenges by which they prove it.
+	if c.sealer != nil && action != chal && action != prov &&
+		!c.registry.heard(from) {
+		return newError(errSeal, "message from %s, which is not a member", from)
+	}
 	switch action {
+	case annc:
+		return c.update(from, payload[headerLength:])
+	case chal:
+		return c.prove(from, payload[headerLength:])
+	case data:
+		return c.streams.data(from, payload[headerLength:])
+	case flow:
+		return c.streams.flow(from, payload[headerLength:])
+	case prov:
+		return c.proven(from, payload[headerLength:])
 	case recv:
-		return c.receive(payload[headerLength:])
+		return c.receive(from, payload[headerLength:])
 	case repl:
-		return c.reply(payload[headerLength:])
+		return c.reply(from, payload[headerLength:])
 	default:
 		return newError(errDispatchAction, "bad dispatch action: %s", action)
 	}
@@ -126,142 +384,955 @@ func (c *Client) dispatch(payload []byte) error {
 // For example, a request to the path /bar?baz=qux of a service called
 // foo-service would have the URL:
 // 	sleuth://foo-service/bar?baz=qux
+// If the request's context is canceled or its deadline passes before a
+// response arrives, Do returns an error that wraps the context's error. The
+// deadline, if any, is sent along with the request so that the handler of the
+// serving peer receives a context that expires at the same time.
+// Large request bodies are streamed to the serving peer as it reads them, and
+// large response bodies are streamed back as the caller reads them, so neither
+// needs to fit in memory. Handlers may also use http.Flusher to stream their
+// response, e.g., for server-sent events. A streamed response has a
+// ContentLength of -1 and its Body should be closed. Canceling the request's
+// context or closing the Body of a streamed response before it has been read
+// cancels the context of the handler serving the request.
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
-	if c.closed {
+	// Once a request is sent, its body belongs to reqMarshal. If it fails
+	// before then, its body is closed here, as http.RoundTripper requires.
+	sent := false
+	defer func() {
+		if !sent && req.Body != nil {
+			req.Body.Close()
+		}
+	}()
+	if atomic.LoadInt32(&c.closed) == 1 {
 		return nil, newError(errClosed, "client is closed").escalate(errDo)
 	}
+	c.work.add()
+	defer c.work.done()
 	url := req.URL.String()
 	to := req.URL.Host
-	// Handles are hexadecimal strings that are incremented by one.
-	handle := strconv.FormatInt(c.handle, 16)
-	c.handle++
 	if req.URL.Scheme != scheme {
 		err := newError(errScheme, "URL scheme must be \"%s\" in %s", scheme, url)
 		return nil, err
 	}
+	ctx := req.Context()
+	if ctx.Err() != nil {
+		return nil, canceled(ctx, req.Method, to, url)
+	}
 	peers, ok := c.services.get(to)
 	if !ok {
 		return nil, newError(errUnknownService, "%s is an unknown service", to)
 	}
-	payload, err := reqMarshal(c.group, c.node.UUID(), handle, req)
+	strategy := c.strategy(to, req.Header.Get(BalancerHeader))
+	if _, ok := strategies[strategy]; !ok {
+		err := newError(errBalancer, "%s is an unknown balancer", strategy)
+		return nil, err.escalate(errDo)
+	}
+	version := req.Header.Get(VersionHeader)
+	want, err := parseConstraint(version)
 	if err != nil {
 		return nil, err.(*Error).escalate(errDo)
 	}
-	p := peers.next()
-	c.log.Debug("sleuth: %s %s via %s", req.Method, url, p.name)
-	if err = c.node.Whisper(p.node, payload); err != nil {
-		return nil, newError(errReqWhisper, err.Error())
+	key := req.Header.Get(KeyHeader)
+	percentile, hedged, err := hedging(req)
+	if err != nil {
+		return nil, err.(*Error).escalate(errDo)
 	}
-	listener := make(chan *http.Response, 1)
-	c.listen(handle, listener)
-	response := <-listener
-	if response != nil {
-		return response, nil
+	attempts := c.Retry.attempts(req)
+	var budget time.Time
+	if attempts > 1 && c.Retry.Budget > 0 {
+		budget = time.Now().Add(c.Retry.Budget)
+	}
+	// Each retry goes to a peer that has not been tried yet, if there is one.
+	tried := make(map[string]struct{})
+	eligible := func(p *peer) bool {
+		return want.match(p.version)
+	}
+	untried := func(p *peer) bool {
+		_, ok := tried[p.name]
+		return !ok && eligible(p)
 	}
-	return nil, newError(errTimeout, "%s {%s}%s timed out", req.Method, to, url)
+	// choose picks a peer whose circuit breaker lets a request be sent to it,
+	// passing over the peers whose breakers do not.
+	choose := func(filter func(*peer) bool) *peer {
+		refused := make(map[string]struct{})
+		allowed := func(p *peer) bool {
+			_, ok := refused[p.name]
+			return !ok && filter(p)
+		}
+		for {
+			p := peers.pick(strategy, key, allowed, c.outstanding)
+			if p == nil || c.acquire(p) {
+				return p
+			}
+			refused[p.name] = struct{}{}
+		}
+	}
+	next := func() *peer {
+		p := choose(untried)
+		if p != nil {
+			tried[p.name] = struct{}{}
+		}
+		return p
+	}
+	var trace []int
+	made := 0 // attempts actually sent
+	for i := 1; ; i++ {
+		p := choose(untried)
+		if p == nil {
+			p = choose(eligible)
+		}
+		if p == nil && peers.count(want) > 0 {
+			format := "%s has no peers that are not ejected by circuit breakers"
+			err = newError(errBreaker, format, to)
+			break
+		}
+		if p == nil {
+			format := "%s has no peers that match version %s"
+			err = newError(errUnknownService, format, to, version)
+			break
+		}
+		tried[p.name] = struct{}{}
+		attemptReq := req
+		if i > 1 && req.GetBody != nil {
+			attemptReq = new(http.Request)
+			*attemptReq = *req
+			if attemptReq.Body, err = req.GetBody(); err != nil {
+				err = newError(errRetry, err.Error())
+				break
+			}
+		}
+		c.log.Debug("sleuth: %s %s via %s (%s)", req.Method, url, p.name, strategy)
+		var delay time.Duration
+		if hedged {
+			delay, _ = c.latencies.percentile(to, percentile)
+		}
+		sent = true
+		made++
+		response, failure := c.send(attemptReq, p, delay, next)
+		if failure == nil {
+			response.Request = req
+			return response, nil
+		}
+		err = failure
+		if i == attempts || !retriable(failure) {
+			break
+		}
+		trace = append(trace, failure.Codes...)
+		backoff := c.Retry.backoff(i)
+		if !budget.IsZero() && time.Now().Add(backoff).After(budget) {
+			break
+		}
+		c.log.Debug("sleuth: %s %s retry %d: %s", req.Method, url, i,
+			failure.Error())
+		if backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, canceled(ctx, req.Method, to, url)
+			}
+		}
+	}
+	if trace == nil {
+		return nil, err
+	}
+	// The codes of every attempt are kept so that callers can see why each
+	// attempt failed.
+	last := err.(*Error)
+	format := "%s {%s}%s failed after %d attempts: %s"
+	failure := newError(errRetry, format, req.Method, to, url,
+		made, last.message)
+	failure.Codes = append(append(trace, last.Codes...), errRetry)
+	failure.cause = last
+	return nil, failure
 }
 
-func (c *Client) has(required map[string]struct{}) bool {
-	// Check to see if required services already exist locally.
-	available := 0
-	for service := range required {
-		if peers, ok := c.services.get(service); ok && peers.available() {
-			available += 1
+// enter adds a node that has entered the network to the group and to the
+// workers of each service it offers. If the group has a key, nodes that do not
+// prove they have it are refused.
+func (c *Client) enter(event *Event) error {
+	group := event.Headers["group"]
+	if group != c.group {
+		c.log.Debug("sleuth: no group header for %s, client-only", event.Name)
+		return nil
+	}
+	// If the group has a key, a node with signed headers is only welcomed once
+	// it has answered a challenge, because its headers could be recorded.
+	if c.sealer != nil {
+		if !c.sealer.verify(event) {
+			c.log.Reject("sleuth: %s has no valid signature for %s", event.Name, c.group)
+			return nil
+		}
+		proven, err := c.challenge(event.Node, event)
+		if err != nil || proven == nil {
+			return err
 		}
 	}
-	return available == len(required)
+	return c.welcome(event)
 }
 
-func (c *Client) listen(handle string, listener chan *http.Response) {
+func (c *Client) has(required map[string]*requirement) bool {
+	return len(c.missing(required)) == 0
+}
+
+// hedge sends a copy of a request to the peer returned by next. It returns nil
+// if there is no other peer or the copy cannot be sent.
+func (c *Client) hedge(req *http.Request, next func() *peer) *attempt {
+	p := next()
+	if p == nil {
+		return nil
+	}
+	copied := new(http.Request)
+	*copied = *req
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil
+		}
+		copied.Body = body
+	}
+	c.log.Debug("sleuth: %s %s hedged via %s", req.Method, req.URL, p.name)
+	a, err := c.start(copied, p)
+	if err != nil {
+		c.report(p, true)
+		c.log.Debug("sleuth: hedge failed: %s", err.Error())
+		return nil
+	}
+	return a
+}
+
+// join records a member of the group and, if the services of the client have
+// changed since its node started, tells the member which services it offers.
+func (c *Client) join(event *Event) error {
+	c.registry.Lock()
+	defer c.registry.Unlock()
+	c.registry.members[event.Node] = event
+	if !c.registry.changed {
+		return nil
+	}
+	payload, err := c.registry.announcement(c.group)
+	if err != nil {
+		return err
+	}
+	if err := c.node.Whisper(event.Node, payload); err != nil {
+		return newError(errANNC, err.Error())
+	}
+	return nil
+}
+
+func (c *Client) listen(handle, node string, listener chan *http.Response) {
 	c.listener.Lock()
 	defer c.listener.Unlock()
 	c.listener.handles[handle] = listener
-	go c.timeout(handle)
+	c.listener.nodes[handle] = node
+	c.listener.outstanding[node]++
+}
+
+// listedVersion returns the version of a service that a peer is listed with.
+func (c *Client) listedVersion(name, service string) string {
+	if peers, ok := c.services.get(service); ok {
+		if p, ok := peers.find(name); ok {
+			return p.version
+		}
+	}
+	return ""
+}
+
+// missing returns the sorted list of required services that are not available.
+func (c *Client) missing(required map[string]*requirement) []string {
+	var missing []string
+	for name, r := range required {
+		available, count := 0, r.count
+		if peers, ok := c.services.get(r.service); ok {
+			available = peers.count(r.want)
+		}
+		if count < 1 {
+			count = 1
+		}
+		if available < count && count > 1 {
+			missing = append(missing,
+				fmt.Sprintf("%s (%d/%d)", name, available, count))
+		} else if available < count {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// outstanding returns the number of requests to a peer node that are waiting
+// for a response.
+func (c *Client) outstanding(node string) int {
+	c.listener.Lock()
+	defer c.listener.Unlock()
+	return c.listener.outstanding[node]
+}
+
+// Peers returns information about every peer offering a service, sorted by
+// peer name. It returns nil if no peers offer the service.
+func (c *Client) Peers(service string) []PeerInfo {
+	peers, ok := c.services.get(service)
+	if !ok {
+		return nil
+	}
+	list := peers.all()
+	infos := make([]PeerInfo, len(list))
+	for i, p := range list {
+		infos[i] = p.info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// prove answers the challenge of a peer (PROV command), and challenges the peer
+// in turn if it has not been challenged yet. The challenge is sent first so
+// that the peer is asked before it can send anything else.
+func (c *Client) prove(from string, nonce []byte) error {
+	proven, err := c.challenge(from, nil)
+	if err != nil {
+		return err
+	}
+	if err := c.node.Whisper(from, append([]byte(c.group+prov), nonce...)); err != nil {
+		return newError(errChallenge, err.Error())
+	}
+	if proven != nil {
+		return c.welcome(proven)
+	}
+	return nil
 }
 
-func (c *Client) receive(payload []byte) error {
+// proven checks the answer of a peer to its challenge and welcomes the peer if
+// it has entered.
+func (c *Client) proven(from string, nonce []byte) error {
+	c.registry.Lock()
+	pending, ok := c.registry.challenges[from]
+	if !ok || pending.proven || string(nonce) != pending.nonce {
+		c.registry.Unlock()
+		c.log.Reject("sleuth: %s has not proven it belongs to %s", from, c.group)
+		return newError(errChallenge, "unexpected answer from %s", from)
+	}
+	pending.proven = true
+	event := pending.event
+	if event != nil {
+		delete(c.registry.challenges, from)
+	}
+	c.registry.Unlock()
+	if event == nil {
+		return nil
+	}
+	return c.welcome(event)
+}
+
+func (c *Client) receive(from string, payload []byte) error {
 	handle, res, err := resUnmarshal(payload)
 	if err != nil {
 		return err.(*Error).escalate(errRECV)
 	}
 	c.listener.Lock()
 	defer c.listener.Unlock()
-	if listener, ok := c.listener.handles[handle]; ok {
-		listener <- res
-		delete(c.listener.handles, handle)
-		return nil
+	listener, ok := c.listener.handles[handle]
+	if !ok {
+		return newError(errRECV, "unknown handle %s", handle)
 	}
-	return newError(errRECV, "unknown handle %d", handle)
+	// A response without a body is followed by a stream of chunks.
+	if res.Body == nil {
+		res.Body = c.streams.reader(context.Background(), &link{
+			group:  c.group,
+			handle: handle,
+			node:   c.node,
+			origin: c.node.UUID(),
+			peer:   from,
+		})
+	}
+	listener <- res
+	c.listener.release(handle)
+	return nil
 }
 
 func (c *Client) remove(name string) {
-	if service, ok := c.directory[name]; ok {
-		if peers, ok := c.services.get(service); ok {
-			if remaining, _ := peers.remove(name); remaining == 0 {
-				c.services.remove(service)
-			}
-		}
-		delete(c.directory, name)
-		c.log.Info("sleuth: remove %s:%s", service, name)
+	services, ok := c.directory[name]
+	if !ok {
+		return
+	}
+	for _, service := range services {
+		c.withdraw(name, service)
 	}
 }
 
-func (c *Client) reply(payload []byte) error {
+// Register offers a service, e.g., once it has warmed up, from a client that
+// is already on the network. Peers are told about the service and start
+// sending it requests. A client that was created in client-only mode becomes
+// a server when it registers its first service.
+func (c *Client) Register(service, version string, handler http.Handler) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return newError(errClosed, "client is closed").escalate(errRegister)
+	}
+	if service == "" || handler == nil {
+		return newError(errRegister, "service and handler are required")
+	}
+	if version == "" {
+		version = "unknown"
+	}
+	c.registry.Lock()
+	defer c.registry.Unlock()
+	if c.registry.draining {
+		return newError(errRegister, "client is shutting down")
+	}
+	if _, ok := c.registry.handlers[service]; ok {
+		return newError(errRegister, "%s is already registered", service)
+	}
+	c.registry.handlers[service] = handler
+	c.registry.versions[service] = version
+	if c.registry.primary == "" {
+		c.registry.primary = service
+	}
+	c.log.Info("sleuth: register %s/%s", service, version)
+	return c.announce()
+}
+
+func (c *Client) reply(from string, payload []byte) error {
 	dest, req, err := reqUnmarshal(c.group, payload)
 	if err != nil {
 		return err.(*Error).escalate(errREPL)
 	}
-	c.handler.ServeHTTP(newWriter(c.node, dest), req)
+	// A request is answered, limited, and admitted as coming from the node the
+	// transport received it from. The node it names could be forged.
+	dest.node = from
+	// Handlers are told which peer sent the request so that they can
+	// authorize and audit it.
+	req = identify(req, c.registry.caller(from))
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if dest.deadline.IsZero() {
+		ctx, cancel = context.WithCancel(req.Context())
+	} else {
+		ctx, cancel = context.WithDeadline(req.Context(), dest.deadline)
+	}
+	req = req.WithContext(ctx)
+	// The body of a streamed request is registered before the handler runs so
+	// that no chunk can arrive before there is somewhere to put it.
+	if dest.stream {
+		req.Body = c.streams.reader(ctx, &link{
+			group:  c.group,
+			handle: dest.handle,
+			node:   c.node,
+			origin: dest.node,
+			peer:   dest.node,
+			upload: true,
+		})
+	}
+	// Handlers run in their own goroutine because they may need to wait for
+	// chunks of a streamed body, which arrive through the same event loop. If
+	// the client limits its concurrency and its queue is full, the request is
+	// rejected instead of waiting.
+	c.work.add()
+	service, handler := c.registry.route(dest.service)
+	if status, wait := c.admit(from, service, req); status != 0 {
+		c.log.Reject("sleuth: %s %s from %s rejected with %d",
+			req.Method, req.URL.String(), from, status)
+		go c.serve(dest, rejected(status, wait), req, cancel)
+		return nil
+	}
+	if !c.queue.push(func() { c.serve(dest, handler, req, cancel) }) {
+		c.log.Warn("sleuth: queue is full, rejecting %s %s [%d]",
+			req.Method, req.URL.String(), warnOverload)
+		go c.serve(dest, rejected(http.StatusServiceUnavailable, 0), req, cancel)
+	}
 	return nil
 }
 
-func (c *Client) timeout(handle string) {
-	<-time.After(c.Timeout)
+// report tells the circuit breaker of a peer whether a request has failed.
+func (c *Client) report(p *peer, failed bool) {
+	if c.Breaker != nil {
+		p.breaker.record(c.Breaker, failed, time.Now())
+	}
+}
+
+// RoundTrip executes a single sleuth transaction and allows Client to conform
+// to the http.RoundTripper interface. It is equivalent to Do.
+func (c *Client) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.Do(req)
+}
+
+func (c *Client) send(req *http.Request, p *peer, delay time.Duration,
+	next func() *peer) (*http.Response, *Error) {
+	ctx := req.Context()
+	url := req.URL.String()
+	to := req.URL.Host
+	first, err := c.start(req, p)
+	if err != nil {
+		c.report(p, true)
+		return nil, err
+	}
+	pending := []*attempt{first}
+	timer := time.NewTimer(c.Timeout)
+	defer timer.Stop()
+	var hedge <-chan time.Time
+	if delay > 0 && next != nil {
+		hedger := time.NewTimer(delay)
+		defer hedger.Stop()
+		hedge = hedger.C
+	}
+	var second <-chan *http.Response
+	var failure *Error
+	for failure == nil {
+		var response *http.Response
+		var winner *attempt
+		select {
+		case response = <-first.listener:
+			winner = first
+		case response = <-second:
+			winner = pending[1]
+		case <-hedge:
+			hedge = nil
+			if attempt := c.hedge(req, next); attempt != nil {
+				pending = append(pending, attempt)
+				second = attempt.listener
+			}
+			continue
+		case <-timer.C:
+			failure = newError(errTimeout, "%s {%s}%s timed out", req.Method, to, url)
+			continue
+		case <-ctx.Done():
+			failure = canceled(ctx, req.Method, to, url)
+			continue
+		}
+		c.latencies.record(to, time.Since(winner.sent))
+		c.report(winner.peer, response.StatusCode >= 500)
+		for _, attempt := range pending {
+			if attempt != winner {
+				c.abandon(attempt, nil)
+			}
+		}
+		if body, ok := response.Body.(*inbound); ok {
+			body.watch(ctx)
+		}
+		return response, nil
+	}
+	for _, attempt := range pending {
+		// Only a peer that has not responded in time has failed.
+		if failure.Codes[0] == errTimeout {
+			c.report(attempt.peer, true)
+		}
+		c.abandon(attempt, failure)
+	}
+	return nil, failure
+}
+
+func (c *Client) serve(dest *destination, handler http.Handler,
+	req *http.Request, cancel func()) {
+	defer c.work.done()
+	key := streamKey(dest.node, dest.handle, false)
+	c.streams.serving(key, cancel)
+	defer c.streams.served(key)
+	defer cancel()
+	w := newWriter(req.Context(), c.node, dest, c.streams)
+	handler.ServeHTTP(w, req)
+	// If the handler has not read all of a streamed body, stop its upload.
+	req.Body.Close()
+	if err := w.close(); err != nil {
+		c.log.Error(err.(*Error).escalate(errREPL).Error())
+	}
+}
+
+// Services returns the sorted names of the services that are available.
+func (c *Client) Services() []string {
+	return c.services.names()
+}
+
+// Shutdown leaves the sleuth network gracefully. It tells peers to stop sending
+// requests to the client's services, waits for the requests the client is
+// serving and the calls to Do that are outstanding to finish, and then closes
+// the client. If the context is done first, the client is closed anyway and
+// Shutdown returns an error that wraps the context's error.
+func (c *Client) Shutdown(ctx context.Context) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return newError(errClosed, "client is closed").escalate(errShutdown)
+	}
+	c.registry.Lock()
+	c.registry.draining = true
+	err := c.announce()
+	c.registry.Unlock()
+	if err != nil {
+		c.log.Error(err.(*Error).escalate(errShutdown).Error())
+	}
+	c.log.Info("sleuth: %s draining...", c.node.Name())
+	select {
+	case <-c.work.wait():
+		return c.Close()
+	case <-ctx.Done():
+		code := errCanceled
+		if ctx.Err() == context.DeadlineExceeded {
+			code = errDeadline
+		}
+		format := "%d requests still outstanding: %s"
+		err := newError(code, format, c.work.outstanding(), ctx.Err().Error())
+		err.cause = ctx.Err()
+		c.Close()
+		return err.escalate(errShutdown)
+	}
+}
+
+// start sends a request to a peer and returns the attempt that is waiting for
+// its response.
+func (c *Client) start(req *http.Request, p *peer) (*attempt, *Error) {
+	// Handles are hexadecimal strings that are incremented by one.
+	// They are allocated atomically because Do may be called concurrently.
+	handle := strconv.FormatInt(atomic.AddInt64(&c.handle, 1)-1, 16)
+	payload, upload, err := reqMarshal(c.group, c.node.UUID(), handle, req)
+	if err != nil {
+		return nil, err.(*Error).escalate(errDo)
+	}
+	a := &attempt{
+		handle:   handle,
+		listener: make(chan *http.Response, 1),
+		peer:     p,
+	}
+	// Listen before whispering so that a quick response cannot be missed.
+	c.listen(handle, p.node, a.listener)
+	if upload != nil {
+		a.out = c.streams.writer(req.Context(), &link{
+			group:  c.group,
+			handle: handle,
+			node:   c.node,
+			origin: c.node.UUID(),
+			peer:   p.node,
+			upload: true,
+		})
+	}
+	a.sent = time.Now()
+	if err = c.node.Whisper(p.node, payload); err != nil {
+		c.unlisten(handle)
+		if upload != nil {
+			c.streams.remove(a.out.key(), false)
+			upload.Close()
+		}
+		return nil, newError(errReqWhisper, err.Error())
+	}
+	if upload != nil {
+		go c.upload(a.out, upload)
+	}
+	return a, nil
+}
+
+// strategy returns the load-balancing strategy for a request to a service. A
+// strategy set on the request wins over one configured for the service, which
+// wins over the default strategy of the client.
+func (c *Client) strategy(service, requested string) string {
+	if requested != "" {
+		return requested
+	}
+	if strategy, ok := c.balancers[service]; ok {
+		return strategy
+	}
+	return c.balancer
+}
+
+// Subscribe returns a subscription to the membership changes of the sleuth
+// network. If services are given, only changes to those services are
+// delivered. The subscription should be closed when it is no longer needed.
+func (c *Client) Subscribe(services ...string) *Subscription {
+	subscription := &Subscription{
+		changes:     make(chan Change, buffer),
+		subscribers: c.subscribers,
+	}
+	if len(services) > 0 {
+		subscription.services = make(map[string]struct{})
+		for _, service := range services {
+			subscription.services[service] = struct{}{}
+		}
+	}
+	c.subscribers.add(subscription)
+	return subscription
+}
+
+// Unregister stops offering a service. Peers are told that the service is gone
+// and stop sending it requests, but requests it is already serving complete.
+func (c *Client) Unregister(service string) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return newError(errClosed, "client is closed").escalate(errRegister)
+	}
+	c.registry.Lock()
+	defer c.registry.Unlock()
+	if _, ok := c.registry.handlers[service]; !ok {
+		return newError(errRegister, "%s is not registered", service)
+	}
+	delete(c.registry.handlers, service)
+	delete(c.registry.versions, service)
+	// Requests that do not name a service go to the first service still
+	// registered by name, which is the one peers now attribute the client to.
+	if c.registry.primary == service {
+		c.registry.primary = ""
+		for name := range c.registry.handlers {
+			if c.registry.primary == "" || name < c.registry.primary {
+				c.registry.primary = name
+			}
+		}
+	}
+	c.log.Info("sleuth: unregister %s", service)
+	return c.announce()
+}
+
+func (c *Client) unlisten(handle string) {
 	c.listener.Lock()
 	defer c.listener.Unlock()
-	if listener, ok := c.listener.handles[handle]; ok {
-		listener <- nil
-		delete(c.listener.handles, handle)
+	c.listener.release(handle)
+}
+
+// update applies the services a peer has announced, adding the ones it has
+// registered and withdrawing the ones it has unregistered.
+func (c *Client) update(from string, payload []byte) error {
+	enter, ok := c.registry.member(from)
+	if !ok {
+		return newError(errANNC, "unknown node %s", from)
+	}
+	unzipped, err := unzip(payload)
+	if err != nil {
+		return err.(*Error).escalate(errANNC)
+	}
+	headers := make(map[string]string, len(enter.Headers)+1)
+	for key, value := range enter.Headers {
+		headers[key] = value
+	}
+	headers["services"] = string(unzipped)
+	peers, err := advertised(&Event{
+		Type:    EventEnter,
+		Name:    enter.Name,
+		Node:    enter.Node,
+		Headers: headers,
+	})
+	if err != nil {
+		return err.(*Error).escalate(errANNC)
+	}
+	offered := make(map[string]string)
+	for _, p := range peers {
+		offered[p.service] = p.version
+	}
+	// The requests of the peer are attributed to the service in its type
+	// header if it still offers it, or else to the first it offers by name.
+	if version, ok := offered[headers["type"]]; ok {
+		headers["version"] = version
+	} else if len(peers) > 0 {
+		headers["type"], headers["version"] = peers[0].service, peers[0].version
+	} else {
+		delete(headers, "type")
+		delete(headers, "version")
+	}
+	c.registry.refresh(&Event{
+		Type:    EventEnter,
+		Name:    enter.Name,
+		Node:    enter.Node,
+		Headers: headers,
+	})
+	// Services that are no longer offered are withdrawn, and so are services
+	// whose version has changed, so that they are added again as new peers.
+	listed := make(map[string]bool)
+	for _, service := range append([]string(nil), c.directory[enter.Name]...) {
+		version, ok := offered[service]
+		if ok && c.listedVersion(enter.Name, service) == version {
+			listed[service] = true
+			continue
+		}
+		c.withdraw(enter.Name, service)
+	}
+	for _, p := range peers {
+		if listed[p.service] {
+			continue
+		}
+		if err := c.add(headers["group"], p); err != nil {
+			return err.(*Error).escalate(errANNC)
+		}
+	}
+	return nil
+}
+
+// upload streams a request body to the serving peer.
+func (c *Client) upload(out *outbound, body io.ReadCloser) {
+	defer body.Close()
+	buffer := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(body, buffer)
+		end := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !end {
+			out.abort(newError(errStream, "body: %s", err.Error()))
+			return
+		}
+		if err := out.write(buffer[:n], end); err != nil || end {
+			return
+		}
 	}
 }
 
-// WaitFor blocks until the required services are available to the client.
+// welcome adds the services a member of the group offers.
+func (c *Client) welcome(event *Event) error {
+	if err := c.join(event); err != nil {
+		return err
+	}
+	peers, err := advertised(event)
+	if err != nil {
+		return err
+	}
+	for _, p := range peers {
+		if err := c.add(event.Headers["group"], p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withdraw removes a peer from the workers of a service.
+func (c *Client) withdraw(name, service string) {
+	if peers, ok := c.services.get(service); ok {
+		remaining, p := peers.remove(name)
+		if remaining == 0 {
+			c.services.remove(service)
+		}
+		if p != nil {
+			info := p.info()
+			changes := []Change{{Peer: info, Service: service, Type: PeerLeft}}
+			if remaining == 0 {
+				changes = append(changes, Change{
+					Peer:    info,
+					Service: service,
+					Type:    ServiceUnavailable,
+				})
+			}
+			c.subscribers.publish(changes...)
+		}
+	}
+	var services []string
+	for _, listed := range c.directory[name] {
+		if listed != service {
+			services = append(services, listed)
+		}
+	}
+	if c.directory[name] = services; len(services) == 0 {
+		delete(c.directory, name)
+	}
+	c.log.Info("sleuth: remove %s:%s", service, name)
+}
+
+// WaitFor blocks until the required services are available to the client. A
+// service can be followed by "@" and a version constraint (see VersionHeader)
+// in order to wait for a peer whose version satisfies it, e.g.:
+// 	client.WaitFor("user-service@>=2.1 <3")
+// WaitFor returns an error if the client is closed before the services are.
 func (c *Client) WaitFor(services ...string) error {
-	if c.closed {
+	return c.WaitForContext(context.Background(), services...)
+}
+
+// WaitForContext is like WaitFor, but it also returns an error if the context
+// is done before the services are available. That error lists the services
+// that are still missing and wraps the context's error.
+func (c *Client) WaitForContext(ctx context.Context, services ...string) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
 		return newError(errClosed, "client is closed").escalate(errWait)
 	}
 	// Collapse services and make sure all values are unique.
-	required := make(map[string]struct{})
+	required := make(map[string]*requirement)
 	for _, service := range services {
-		required[service] = struct{}{}
+		r, err := newRequirement(service)
+		if err != nil {
+			return err.(*Error).escalate(errWait)
+		}
+		required[service] = r
 	}
 	if len(required) != len(services) {
 		c.log.Warn("sleuth: %v contains duplicates [%d]", services, warnDuplicate)
 	}
-	if !c.has(required) {
-		c.block(required, services)
+	if _, err := c.block(ctx, required, services); err != nil {
+		return err.escalate(errWait)
+	}
+	return nil
+}
+
+// WaitForQuorum blocks until every requirement is met by enough peers, the
+// context is done, or the client is closed. If the context is done first, the
+// error lists each requirement that is still missing peers.
+func (c *Client) WaitForQuorum(ctx context.Context,
+	requirements ...Requirement) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return newError(errClosed, "client is closed").escalate(errWait)
+	}
+	required := make(map[string]*requirement)
+	names := make([]string, 0, len(requirements))
+	for _, requirement := range requirements {
+		name := requirement.Service
+		if requirement.Version != "" {
+			name += "@" + requirement.Version
+		}
+		r, err := newRequirement(name)
+		if err != nil {
+			return err.(*Error).escalate(errWait)
+		}
+		if r.count = requirement.Count; r.count < 1 {
+			r.count = 1
+		}
+		if r.count > 1 {
+			name = fmt.Sprintf("%s*%d", name, r.count)
+		}
+		required[name] = r
+		names = append(names, name)
+	}
+	if len(required) != len(requirements) {
+		c.log.Warn("sleuth: %v contains duplicates [%d]", names, warnDuplicate)
+	}
+	if _, err := c.block(ctx, required, names); err != nil {
+		return err.escalate(errWait)
 	}
 	return nil
 }
 
-func newClient(group string, node *gyre.Gyre, out *logger.Logger) *Client {
+// canceled returns the error for a request whose context is done before a
+// response has arrived.
+func canceled(ctx context.Context, method, to, url string) *Error {
+	code := errCanceled
+	if ctx.Err() == context.DeadlineExceeded {
+		code = errDeadline
+	}
+	err := newError(code, "%s {%s}%s %s", method, to, url, ctx.Err().Error())
+	err.cause = ctx.Err()
+	return err
+}
+
+func newClient(group string, node Transport, out *logger.Logger) *Client {
 	return &Client{
-		additions: &notifier{
-			Mutex:  new(sync.Mutex),
-			stream: make(chan struct{}),
-		},
-		directory: make(map[string]string),
+		additions: newNotifier(),
+		balancer:  RoundRobin,
+		balancers: make(map[string]string),
+		directory: make(map[string][]string),
 		group:     group,
+		latencies: newLatencies(),
 		listener: &listener{
-			Mutex:   new(sync.Mutex),
-			handles: make(map[string]chan *http.Response),
+			Mutex:       new(sync.Mutex),
+			handles:     make(map[string]chan *http.Response),
+			nodes:       make(map[string]string),
+			outstanding: make(map[string]int),
 		},
-		log:     out,
-		node:    node,
-		Timeout: time.Millisecond * 500,
+		log:         out,
+		node:        node,
+		registry:    newRegistry(),
+		Timeout:     time.Millisecond * 500,
+		streams:     newStreams(),
+		work:        newWork(),
+		subscribers: newSubscribers(),
 		services: &pool{
 			Mutex:   new(sync.Mutex),
 			workers: make(map[string]*workers),
 		},
 	}
 }
+
+func newRequirement(service string) (*requirement, error) {
+	r := &requirement{count: 1, service: service}
+	if i := strings.IndexByte(service, '@'); i >= 0 {
+		want, err := parseConstraint(service[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		r.service, r.want = service[:i], want
+	}
+	return r, nil
+}
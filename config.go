@@ -11,19 +11,64 @@ import (
 )
 
 // Config is the configuration specification for sleuth client instantiation.
-// It has JSON tag values defined for all public fields except Handler in order
-// to allow users to store sleuth configuration in JSON files. All fields are
-// optional, but Interface is particularly important to guarantee all peers
-// reside on the same subnet.
+// It has JSON tag values defined for all public fields except Admission,
+// Handler, and Transport in order to allow users to store sleuth configuration
+// in JSON files. All fields are optional, but Interface is particularly important to
+// guarantee all peers reside on the same subnet.
 type Config struct {
 	group string
 
+	// Admission is called for each incoming request that the rate limits of
+	// the service admit, so that applications can reject it, e.g., because
+	// the calling node is not allowed to make it.
+	Admission Admission `json:"-"`
+
+	// Backend is the built-in transport sleuth uses when Transport is nil. The
+	// options are:
+	// "gyre"   A Gyre node, which requires libzmq and cgo. This is the default
+	//          when cgo is available.
+	// "native" A pure-Go transport that discovers peers with a UDP multicast
+	//          beacon and whispers over TCP. This is the default otherwise.
+	// The two backends do not interoperate, so all peers must use the same one.
+	Backend string `json:"backend,omitempty"`
+
+	// Balancer is the load-balancing strategy used to choose which peer offering
+	// a service receives a request. The options are "round-robin" (the default),
+	// "random", "least-outstanding", "power-of-two", "weighted", and
+	// "consistent-hash". Requests can override it with the X-Sleuth-Balancer
+	// header.
+	Balancer string `json:"balancer,omitempty"`
+
+	// Balancers overrides Balancer for specific services. It maps service names
+	// to load-balancing strategies.
+	Balancers map[string]string `json:"balancers,omitempty"`
+
+	// CallerLimit is the rate limit on the requests each calling node makes
+	// to the services being offered. If it is nil, callers are not limited.
+	CallerLimit *Limit `json:"callerlimit,omitempty"`
+
+	// Concurrency is the maximum number of requests a service handles at once.
+	// If it is zero, there is no limit. Requests that arrive when the limit is
+	// reached wait in a queue of length Queue, and requests that arrive when
+	// that queue is full are rejected with a 503 Service Unavailable response.
+	Concurrency int `json:"concurrency,omitempty"`
+
 	// Handler is the HTTP handler for a service made available via sleuth.
 	Handler http.Handler `json:"-"`
 
 	// Interface is the system network interface sleuth should use, e.g. "en0".
 	Interface string `json:"interface,omitempty"`
 
+	// Key is a secret shared by every peer in a group. If it is set, peers sign
+	// the headers they announce with it and answer a new challenge with it from
+	// every peer that discovers them, and peers that cannot prove they have it
+	// are neither added to the group nor sent requests. The messages peers send
+	// one another are encrypted and authenticated with it, and messages from
+	// peers that do not have it, or that have been received before, are
+	// rejected. It should be long and random, e.g., 32 random bytes encoded as
+	// hex.
+	Key string `json:"key,omitempty"`
+
 	// LogLevel is the ursiform.Logger level for sleuth. The default is "silent".
 	// The options, in order of increasing verbosity, are:
 	// "silent"    No log output at all.
@@ -40,18 +85,52 @@ type Config struct {
 	// "debug"     All log output is shown.
 	LogLevel string `json:"loglevel,omitempty"`
 
+	// Metadata is custom information about the service being offered, e.g.,
+	// its region or build, that peers can read with Client.Peers.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
 	// Port is the UDP port that sleuth should broadcast on. The default is 5670.
 	Port int `json:"port,omitempty"`
 
+	// Queue is the number of requests that can wait for a handler when the
+	// Concurrency limit has been reached. The default is zero.
+	Queue int `json:"queue,omitempty"`
+
 	// Service is the name of the service being offered if a Handler exists.
 	Service string `json:"service,omitempty"`
 
+	// Services are the services being offered in addition to, or instead of,
+	// Service, mapped by name. Each has its own handler and version.
+	Services map[string]Service `json:"services,omitempty"`
+
+	// ServiceLimits are the rate limits on the requests each service being
+	// offered receives from all callers, mapped by service name.
+	ServiceLimits map[string]Limit `json:"servicelimits,omitempty"`
+
+	// Transport is the network layer sleuth uses to discover peers and to send
+	// messages. If it is nil, sleuth uses the Backend transport configured with
+	// Interface and Port. A MemoryNetwork provides transports for in-process use.
+	Transport Transport `json:"-"`
+
 	// Version is the optional version string of the service being offered.
 	Version string `json:"version,omitempty"`
 
+	// Weight is the relative share of requests a service receives from clients
+	// that use the "weighted" load-balancing strategy. The default is 1.
+	Weight int `json:"weight,omitempty"`
+
 	logLevel int
 }
 
+// Service is a service offered by a client that has more than one.
+type Service struct {
+	// Handler is the HTTP handler for the service.
+	Handler http.Handler `json:"-"`
+
+	// Version is the optional version string of the service.
+	Version string `json:"version,omitempty"`
+}
+
 func initConfig(config *Config) *Config {
 	if config == nil {
 		config = new(Config)
@@ -59,6 +138,15 @@ func initConfig(config *Config) *Config {
 	if config.group == "" {
 		config.group = group
 	}
+	if config.Backend == "" {
+		config.Backend = defaultBackend
+	}
+	if config.Balancer == "" {
+		config.Balancer = RoundRobin
+	}
+	if config.Weight < 1 {
+		config.Weight = 1
+	}
 	if config.LogLevel == "" {
 		config.LogLevel = "silent"
 	}
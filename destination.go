@@ -4,9 +4,16 @@
 
 package sleuth
 
-// destination describes the group, node, and specific handle of a message.
+import "time"
+
+// destination describes the group, node, and specific handle of a message, as
+// well as the deadline (if any) by which the requester expects a response, the
+// service it is addressed to, and whether the request body follows as a stream.
 type destination struct {
-	group  string
-	handle string
-	node   string
+	deadline time.Time
+	group    string
+	handle   string
+	node     string
+	service  string
+	stream   bool
 }
@@ -11,43 +11,71 @@ const (
 	warnInterface = 801
 	warnClose     = 802
 	warnDuplicate = 803
+	warnOverload  = 804
 	// Errors are in the 901-999 range.
-	errNew              = 901
-	errDispatch         = 902
-	errService          = 903
-	errInitialize       = 904
-	errStart            = 905
-	errJoin             = 906
-	errInterface        = 907
-	errPort             = 908
-	errNodeHeader       = 909
-	errServiceHeader    = 910
-	errVersionHeader    = 911
-	errGroupHeader      = 912
-	errVerbose          = 913
-	errDispatchHeader   = 914
-	errDispatchAction   = 915
-	errScheme           = 916
-	errResUnmarshal     = 917
-	errResUnmarshalJSON = 918
-	errUnknownService   = 919
-	errTimeout          = 920
-	errRECV             = 921
-	errREPL             = 922
-	errLogLevel         = 923
-	errAdd              = 924
-	errReqMarshal       = 925
-	errReqUnmarshal     = 926
-	errReqUnmarshalJSON = 927
-	errReqUnmarshalHTTP = 928
-	errReqWhisper       = 929
-	errResWhisper       = 930
-	errLeave            = 931
-	errUnzip            = 932
-	errUnzipRead        = 933
-	errDo               = 934
-	errClosed           = 935
-	errWait             = 936
+	errNew                = 901
+	errDispatch           = 902
+	errService            = 903
+	errInitialize         = 904
+	errStart              = 905
+	errJoin               = 906
+	errInterface          = 907
+	errPort               = 908
+	errNodeHeader         = 909
+	errServiceHeader      = 910
+	errVersionHeader      = 911
+	errGroupHeader        = 912
+	errVerbose            = 913
+	errDispatchHeader     = 914
+	errDispatchAction     = 915
+	errScheme             = 916
+	errResUnmarshal       = 917
+	errResUnmarshalJSON   = 918
+	errUnknownService     = 919
+	errTimeout            = 920
+	errRECV               = 921
+	errREPL               = 922
+	errLogLevel           = 923
+	errAdd                = 924
+	errReqMarshal         = 925
+	errReqUnmarshal       = 926
+	errReqUnmarshalJSON   = 927
+	errReqUnmarshalHTTP   = 928
+	errReqWhisper         = 929
+	errResWhisper         = 930
+	errLeave              = 931
+	errUnzip              = 932
+	errUnzipRead          = 933
+	errDo                 = 934
+	errClosed             = 935
+	errWait               = 936
+	errCanceled           = 937
+	errDeadline           = 938
+	errMemory             = 939
+	errBackend            = 940
+	errNative             = 941
+	errDATA               = 942
+	errFLOW               = 943
+	errChunkUnmarshal     = 944
+	errChunkUnmarshalJSON = 945
+	errStream             = 946
+	errStreamClosed       = 947
+	errStreamWhisper      = 948
+	errBalancer           = 949
+	errWeightHeader       = 950
+	errVersion            = 951
+	errRetry              = 952
+	errHedge              = 953
+	errBreaker            = 954
+	errMetadataHeader     = 955
+	errServicesHeader     = 956
+	errANNC               = 957
+	errRegister           = 958
+	errShutdown           = 959
+	errLimit              = 960
+	errSeal               = 961
+	errSignatureHeader    = 962
+	errChallenge          = 963
 )
 
 // Error is the type all sleuth errors can be asserted as in order to query
@@ -55,6 +83,7 @@ const (
 type Error struct {
 	// Codes contains the list of error codes that led to a specific error.
 	Codes   []int
+	cause   error
 	message string
 }
 
@@ -63,6 +92,12 @@ func (e *Error) Error() string {
 	return fmt.Sprintf("sleuth: %s %v", e.message, e.Codes)
 }
 
+// Unwrap returns the underlying error, if any, that caused an error. For
+// example, a request that was canceled returns context.Canceled.
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
 func (e *Error) escalate(code int) *Error {
 	e.Codes = append(e.Codes, code)
 	return e
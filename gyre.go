@@ -0,0 +1,96 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package sleuth
+
+import "github.com/zeromq/gyre"
+
+// Gyre depends on libzmq, so it is only the default when cgo is available.
+const defaultBackend = "gyre"
+
+// gyreTransport is the default Transport, backed by a Gyre node.
+type gyreTransport struct {
+	*gyre.Gyre
+	done   chan struct{}
+	events chan *Event
+}
+
+func (g *gyreTransport) Events() <-chan *Event {
+	return g.events
+}
+
+func (g *gyreTransport) SetHeader(name, value string) error {
+	return g.Gyre.SetHeader(name, "%s", value)
+}
+
+func (g *gyreTransport) Start() error {
+	if err := g.Gyre.Start(); err != nil {
+		return err
+	}
+	go g.translate()
+	return nil
+}
+
+func (g *gyreTransport) Stop() error {
+	close(g.done)
+	return g.Gyre.Stop()
+}
+
+// translate converts Gyre events into sleuth events until the node stops.
+func (g *gyreTransport) translate() {
+	defer close(g.events)
+	for {
+		var in *gyre.Event
+		var ok bool
+		select {
+		case in, ok = <-g.Gyre.Events():
+			if !ok {
+				return
+			}
+		case <-g.done:
+			return
+		}
+		out := &Event{Name: in.Name(), Node: in.Sender()}
+		switch in.Type() {
+		case gyre.EventEnter:
+			out.Type = EventEnter
+			out.Headers = in.Headers()
+		case gyre.EventExit, gyre.EventLeave:
+			out.Type = EventExit
+		case gyre.EventWhisper:
+			out.Type = EventWhisper
+			out.Msg = in.Msg()
+		default:
+			continue
+		}
+		select {
+		case g.events <- out:
+		case <-g.done:
+			return
+		}
+	}
+}
+
+func newGyre(port int, adapter string) (Transport, error) {
+	node, err := gyre.New()
+	if err != nil {
+		return nil, newError(errInitialize, err.Error())
+	}
+	if err := node.SetPort(port); err != nil {
+		return nil, newError(errPort, err.Error())
+	}
+	if adapter != "" {
+		if err := node.SetInterface(adapter); err != nil {
+			return nil, newError(errInterface, err.Error())
+		}
+	}
+	return &gyreTransport{
+		Gyre:   node,
+		done:   make(chan struct{}),
+		events: make(chan *Event),
+	}, nil
+}
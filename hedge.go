@@ -0,0 +1,109 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HedgeHeader opts a read-only (GET, HEAD, or OPTIONS) request into hedging.
+// Its value is a percentile, e.g., "95" or "p95". If the peer a hedged request
+// is sent to has not responded once that percentile of the recent response
+// times of the service has passed, a copy of the request is sent to another
+// peer and whichever response arrives first is used. A client only hedges
+// requests to a service once it has seen enough of its responses.
+const HedgeHeader = "X-Sleuth-Hedge"
+
+const (
+	// samples is the number of recent response times kept for each service.
+	samples = 128
+	// minSamples is the number of response times needed before hedging.
+	minSamples = 16
+)
+
+// latencies keeps the recent response times of each service.
+type latencies struct {
+	*sync.Mutex
+	services map[string]*latency
+}
+
+// percentile returns the response time that the given percentage of recent
+// responses from a service arrived within.
+func (l *latencies) percentile(service string,
+	percent float64) (time.Duration, bool) {
+	l.Lock()
+	recent, ok := l.services[service]
+	if !ok || len(recent.durations) < minSamples {
+		l.Unlock()
+		return 0, false
+	}
+	durations := append([]time.Duration(nil), recent.durations...)
+	l.Unlock()
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	index := int(float64(len(durations))*percent/100+0.5) - 1
+	if index < 0 {
+		index = 0
+	} else if index >= len(durations) {
+		index = len(durations) - 1
+	}
+	return durations[index], true
+}
+
+func (l *latencies) record(service string, duration time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	recent, ok := l.services[service]
+	if !ok {
+		recent = new(latency)
+		l.services[service] = recent
+	}
+	if len(recent.durations) < samples {
+		recent.durations = append(recent.durations, duration)
+		return
+	}
+	recent.durations[recent.next] = duration
+	recent.next = (recent.next + 1) % samples
+}
+
+// latency is a ring of the recent response times of a service.
+type latency struct {
+	durations []time.Duration
+	next      int
+}
+
+// hedging returns the percentile after which a request should be hedged and
+// whether it should be hedged at all.
+func hedging(req *http.Request) (float64, bool, error) {
+	value := req.Header.Get(HedgeHeader)
+	if value == "" {
+		return 0, false, nil
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+	default:
+		err := newError(errHedge, "%s requests cannot be hedged", req.Method)
+		return 0, false, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return 0, false, newError(errHedge, "request body cannot be read twice")
+	}
+	percent, err := strconv.ParseFloat(strings.TrimPrefix(value, "p"), 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return 0, false, newError(errHedge, "%s is an invalid percentile", value)
+	}
+	return percent, true, nil
+}
+
+func newLatencies() *latencies {
+	return &latencies{
+		Mutex:    new(sync.Mutex),
+		services: make(map[string]*latency),
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Admission decides whether a service handles an incoming request. It is
+// called with the identifier of the calling node and the name of the service
+// once the request has been admitted by the rate limits of the client, and the
+// request carries the rest of the identity of its caller (see CallerFrom). It
+// returns zero to admit the request or the HTTP status code of the response
+// that rejects it, e.g., http.StatusForbidden.
+type Admission func(node, service string, req *http.Request) int
+
+// Limit is a token-bucket rate limit. Requests that exceed it are rejected
+// with a 429 Too Many Requests response whose Retry-After header says when a
+// request would be admitted again.
+type Limit struct {
+	// Burst is the number of requests that can be admitted at once. Values
+	// less than 1 are treated as 1.
+	Burst int `json:"burst,omitempty"`
+
+	// Rate is the number of requests admitted per second over time. It must be
+	// greater than zero.
+	Rate float64 `json:"rate"`
+}
+
+// take removes a token from a bucket if it has one. Otherwise, it returns how
+// long it will be until the bucket has one.
+func (l *Limit) take(b *bucket, now time.Time, commit bool) time.Duration {
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	tokens := burst
+	if !b.last.IsZero() {
+		tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	}
+	if tokens < 1 {
+		return time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+	}
+	if commit {
+		b.last, b.tokens = now, tokens-1
+	}
+	return 0
+}
+
+// bucket holds the tokens of a rate limit.
+type bucket struct {
+	last   time.Time
+	tokens float64
+}
+
+// limiter keeps a token bucket for each calling node and for each service.
+type limiter struct {
+	*sync.Mutex
+	caller   *Limit
+	callers  map[string]*bucket // map[node-uuid]bucket
+	limits   map[string]Limit   // map[service-type]limit
+	services map[string]*bucket // map[service-type]bucket
+}
+
+// admit takes a token for a request from a node to a service if both of their
+// buckets have one. Otherwise, it returns how long it will be until they do.
+func (l *limiter) admit(node, service string, now time.Time) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.Lock()
+	defer l.Unlock()
+	type check struct {
+		bucket *bucket
+		limit  *Limit
+	}
+	var checks []check
+	if l.caller != nil {
+		if _, ok := l.callers[node]; !ok {
+			l.callers[node] = new(bucket)
+		}
+		checks = append(checks, check{l.callers[node], l.caller})
+	}
+	if limit, ok := l.limits[service]; ok {
+		if _, ok := l.services[service]; !ok {
+			l.services[service] = new(bucket)
+		}
+		checks = append(checks, check{l.services[service], &limit})
+	}
+	var wait time.Duration
+	for _, c := range checks {
+		if d := c.limit.take(c.bucket, now, false); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+	for _, c := range checks {
+		c.limit.take(c.bucket, now, true)
+	}
+	return 0, true
+}
+
+// forget drops the bucket of a node that has left the network.
+func (l *limiter) forget(node string) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	delete(l.callers, node)
+}
+
+// rejected returns a handler that rejects a request with a status code and,
+// if the request can be retried after a delay, a Retry-After header.
+func rejected(status int, wait time.Duration) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if wait > 0 {
+			seconds := int(math.Ceil(wait.Seconds()))
+			res.Header().Set("Retry-After", strconv.Itoa(seconds))
+		}
+		http.Error(res, http.StatusText(status), status)
+	})
+}
+
+// newLimiter returns a limiter for the given limits, or nil if there are none.
+func newLimiter(caller *Limit, limits map[string]Limit) *limiter {
+	if caller == nil && len(limits) == 0 {
+		return nil
+	}
+	l := &limiter{
+		Mutex:    new(sync.Mutex),
+		caller:   caller,
+		callers:  make(map[string]*bucket),
+		limits:   make(map[string]Limit),
+		services: make(map[string]*bucket),
+	}
+	for service, limit := range limits {
+		l.limits[service] = limit
+	}
+	return l
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemoryNetwork is an in-process network that connects every Transport it
+// creates. Clients that use its transports discover and call one another
+// without any network traffic, which makes it useful for tests.
+type MemoryNetwork struct {
+	count int
+	mu    sync.Mutex
+	nodes []*memoryTransport // in the order they started
+}
+
+func (n *MemoryNetwork) broadcast(from *memoryTransport, event *Event) {
+	for _, node := range n.nodes {
+		if node != from {
+			node.events.push(event)
+		}
+	}
+}
+
+func (n *MemoryNetwork) find(node string) (int, *memoryTransport) {
+	for i, t := range n.nodes {
+		if t.uuid == node {
+			return i, t
+		}
+	}
+	return -1, nil
+}
+
+// Transport returns a new Transport attached to the network. It can be used as
+// the Transport field of a Config.
+func (n *MemoryNetwork) Transport() Transport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.count++
+	return &memoryTransport{
+		events:  newEventQueue(),
+		headers: make(map[string]string),
+		groups:  make(map[string]struct{}),
+		name:    fmt.Sprintf("%06X", n.count),
+		network: n,
+		uuid:    fmt.Sprintf("%032X", n.count),
+	}
+}
+
+// NewMemoryNetwork returns an empty in-process network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return new(MemoryNetwork)
+}
+
+type memoryTransport struct {
+	events  *eventQueue
+	groups  map[string]struct{}
+	headers map[string]string
+	name    string
+	network *MemoryNetwork
+	started bool
+	uuid    string
+}
+
+func (t *memoryTransport) enter() *Event {
+	headers := make(map[string]string, len(t.headers))
+	for key, value := range t.headers {
+		headers[key] = value
+	}
+	return &Event{Type: EventEnter, Name: t.name, Node: t.uuid, Headers: headers}
+}
+
+func (t *memoryTransport) Events() <-chan *Event {
+	return t.events.stream
+}
+
+func (t *memoryTransport) exit() *Event {
+	return &Event{Type: EventExit, Name: t.name, Node: t.uuid}
+}
+
+func (t *memoryTransport) Join(group string) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.groups[group] = struct{}{}
+	return nil
+}
+
+func (t *memoryTransport) Leave(group string) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	if _, ok := t.groups[group]; !ok {
+		return newError(errMemory, "%s is not a member of %s", t.name, group)
+	}
+	delete(t.groups, group)
+	t.network.broadcast(t, t.exit())
+	return nil
+}
+
+func (t *memoryTransport) Name() string {
+	return t.name
+}
+
+func (t *memoryTransport) SetHeader(name, value string) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.headers[name] = value
+	return nil
+}
+
+func (t *memoryTransport) Start() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	if t.started {
+		return newError(errMemory, "%s has already been started", t.name)
+	}
+	t.started = true
+	// Peers discover each other immediately, in the order they started.
+	for _, node := range t.network.nodes {
+		t.events.push(node.enter())
+		node.events.push(t.enter())
+	}
+	t.network.nodes = append(t.network.nodes, t)
+	go t.events.pump()
+	return nil
+}
+
+func (t *memoryTransport) Stop() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	i, _ := t.network.find(t.uuid)
+	if i < 0 {
+		return newError(errMemory, "%s is not running", t.name)
+	}
+	t.network.nodes = append(t.network.nodes[:i], t.network.nodes[i+1:]...)
+	t.network.broadcast(t, t.exit())
+	t.events.stop()
+	return nil
+}
+
+func (t *memoryTransport) UUID() string {
+	return t.uuid
+}
+
+func (t *memoryTransport) Whisper(node string, payload []byte) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	if i, _ := t.network.find(t.uuid); i < 0 {
+		return newError(errMemory, "%s is not running", t.name)
+	}
+	_, peer := t.network.find(node)
+	if peer == nil {
+		return newError(errMemory, "%s is not a peer", node)
+	}
+	msg := make([]byte, len(payload))
+	copy(msg, payload)
+	peer.events.push(&Event{Type: EventWhisper, Name: t.name, Node: t.uuid, Msg: msg})
+	return nil
+}
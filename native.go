@@ -0,0 +1,493 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Nodes announce themselves by sending a beacon to this multicast group on
+	// the configured port. A beacon with a port of zero means a node is leaving.
+	nativeGroup    = "239.255.83.76"
+	nativeInterval = time.Second
+	nativeExpiry   = nativeInterval * 5
+	nativeMagic    = "SLTH\x01"
+	nativeMaxFrame = 1 << 26
+)
+
+// Peers exchange length-prefixed frames over TCP. Each node dials every peer it
+// discovers and only ever writes to the connection it dialed.
+const (
+	frameHello byte = iota + 1
+	frameWhisper
+	frameLeave
+)
+
+// hello is the first frame sent on every connection. It is sent again to
+// announce that a node has rejoined.
+type hello struct {
+	Headers map[string]string `json:"headers"`
+	Name    string            `json:"name"`
+	Node    string            `json:"node"`
+	Port    int               `json:"port"`
+}
+
+type nativePeer struct {
+	*sync.Mutex // guards writes to out
+	addr        string
+	dialing     bool
+	entered     bool
+	headers     map[string]string
+	in          net.Conn
+	name        string
+	out         net.Conn
+	seen        time.Time
+}
+
+func (p *nativePeer) close() {
+	if p.in != nil {
+		p.in.Close()
+	}
+	if p.out != nil {
+		p.out.Close()
+	}
+}
+
+func (p *nativePeer) write(kind byte, body []byte) error {
+	p.Lock()
+	defer p.Unlock()
+	return writeFrame(p.out, kind, body)
+}
+
+// nativeTransport is a pure-Go Transport: peers find each other with a UDP
+// multicast beacon and whisper over TCP.
+type nativeTransport struct {
+	*sync.Mutex
+	adapter  string
+	beacon   *net.UDPConn
+	done     chan struct{}
+	events   *eventQueue
+	group    *net.UDPAddr
+	headers  map[string]string
+	listener net.Listener
+	name     string
+	peers    map[string]*nativePeer // map[node-uuid]peer
+	sender   *net.UDPConn
+	uuid     string
+}
+
+func (t *nativeTransport) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.serve(conn)
+	}
+}
+
+func (t *nativeTransport) announce() {
+	ticker := time.NewTicker(nativeInterval)
+	defer ticker.Stop()
+	port := t.listener.Addr().(*net.TCPAddr).Port
+	for {
+		t.sender.WriteToUDP(t.beaconPacket(port), t.group)
+		select {
+		case <-ticker.C:
+			t.expire()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *nativeTransport) beaconPacket(port int) []byte {
+	node, _ := hex.DecodeString(t.uuid)
+	packet := append([]byte(nativeMagic), node...)
+	return append(packet, byte(port>>8), byte(port))
+}
+
+// connect dials a peer and introduces this node to it.
+func (t *nativeTransport) connect(node string, p *nativePeer) {
+	conn, err := net.DialTimeout("tcp4", p.addr, nativeExpiry)
+	// The hello is written before the connection is published as the peer's,
+	// so that nothing can be whispered on it first. If it cannot be written,
+	// the peer is dialed again the next time its beacon arrives.
+	if err == nil {
+		t.Lock()
+		introduction := t.hello()
+		t.Unlock()
+		if err = writeFrame(conn, frameHello, introduction); err != nil {
+			conn.Close()
+		}
+	}
+	t.Lock()
+	p.dialing = false
+	if err != nil || t.peers[node] != p {
+		t.Unlock()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	p.out = conn
+	enter := t.ready(node, p)
+	t.Unlock()
+	if enter != nil {
+		t.events.push(enter)
+	}
+}
+
+// connected returns the peers this node has dialed.
+func (t *nativeTransport) connected() []*nativePeer {
+	t.Lock()
+	defer t.Unlock()
+	peers := make([]*nativePeer, 0, len(t.peers))
+	for _, p := range t.peers {
+		if p.out != nil {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// discover records that a peer is alive and dials it if necessary. The caller
+// must hold the lock.
+func (t *nativeTransport) discover(node, addr string) *nativePeer {
+	p, ok := t.peers[node]
+	if !ok {
+		p = &nativePeer{Mutex: new(sync.Mutex), addr: addr}
+		t.peers[node] = p
+	}
+	p.seen = time.Now()
+	if p.out == nil && !p.dialing {
+		p.dialing = true
+		go t.connect(node, p)
+	}
+	return p
+}
+
+func (t *nativeTransport) Events() <-chan *Event {
+	return t.events.stream
+}
+
+// exit forgets a peer and, if it had entered, notifies the consumer.
+func (t *nativeTransport) exit(node string, p *nativePeer) {
+	t.Lock()
+	if t.peers[node] != p {
+		t.Unlock()
+		return
+	}
+	delete(t.peers, node)
+	entered := p.entered
+	t.Unlock()
+	p.close()
+	if entered {
+		t.events.push(&Event{Type: EventExit, Name: p.name, Node: node})
+	}
+}
+
+func (t *nativeTransport) expire() {
+	t.Lock()
+	expired := make(map[string]*nativePeer)
+	for node, p := range t.peers {
+		if time.Since(p.seen) > nativeExpiry {
+			expired[node] = p
+		}
+	}
+	t.Unlock()
+	for node, p := range expired {
+		t.exit(node, p)
+	}
+}
+
+// hello returns an introduction frame body. The caller must hold the lock.
+func (t *nativeTransport) hello() []byte {
+	port := t.listener.Addr().(*net.TCPAddr).Port
+	// This will never fail to marshal, so error can be ignored.
+	marshalled, _ := json.Marshal(&hello{
+		Headers: t.headers,
+		Name:    t.name,
+		Node:    t.uuid,
+		Port:    port,
+	})
+	return marshalled
+}
+
+func (t *nativeTransport) Join(group string) error {
+	t.Lock()
+	introduction := t.hello()
+	t.Unlock()
+	for _, p := range t.connected() {
+		p.write(frameHello, introduction)
+	}
+	return nil
+}
+
+func (t *nativeTransport) Leave(group string) error {
+	for _, p := range t.connected() {
+		if err := p.write(frameLeave, nil); err != nil {
+			return newError(errNative, err.Error())
+		}
+	}
+	return nil
+}
+
+func (t *nativeTransport) Name() string {
+	return t.name
+}
+
+// ready returns an enter event if a peer has just become reachable in both
+// directions. The caller must hold the lock.
+func (t *nativeTransport) ready(node string, p *nativePeer) *Event {
+	if p.entered || p.in == nil || p.out == nil {
+		return nil
+	}
+	p.entered = true
+	return &Event{Type: EventEnter, Name: p.name, Node: node, Headers: p.headers}
+}
+
+func (t *nativeTransport) receive() {
+	packet := make([]byte, 64)
+	for {
+		n, from, err := t.beacon.ReadFromUDP(packet)
+		if err != nil {
+			select {
+			case <-t.done:
+				return
+			default:
+				continue
+			}
+		}
+		prefix := len(nativeMagic)
+		if n != prefix+18 || !bytes.Equal(packet[:prefix], []byte(nativeMagic)) {
+			continue
+		}
+		node := strings.ToUpper(hex.EncodeToString(packet[prefix : prefix+16]))
+		port := int(binary.BigEndian.Uint16(packet[prefix+16 : n]))
+		if node == t.uuid {
+			continue
+		}
+		t.Lock()
+		p, ok := t.peers[node]
+		if port == 0 {
+			t.Unlock()
+			if ok {
+				t.exit(node, p)
+			}
+			continue
+		}
+		t.discover(node, net.JoinHostPort(from.IP.String(), strconv.Itoa(port)))
+		t.Unlock()
+	}
+}
+
+// serve reads the frames a peer sends on the connection it dialed.
+func (t *nativeTransport) serve(conn net.Conn) {
+	var node string
+	var p *nativePeer
+	defer func() {
+		conn.Close()
+		if p != nil {
+			t.exit(node, p)
+		}
+	}()
+	for {
+		kind, body, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		if p == nil && kind != frameHello {
+			return
+		}
+		switch kind {
+		case frameHello:
+			in := new(hello)
+			if err := json.Unmarshal(body, in); err != nil || in.Node == t.uuid {
+				return
+			}
+			// A connection speaks for one node, and a node that is connected
+			// cannot be claimed by another connection, so that no host can take
+			// over a peer by announcing its identifier.
+			if node != "" && in.Node != node {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			t.Lock()
+			if claimed, ok := t.peers[in.Node]; ok && claimed.in != nil &&
+				claimed.in != conn {
+				t.Unlock()
+				return
+			}
+			node = in.Node
+			p = t.discover(node, net.JoinHostPort(host, strconv.Itoa(in.Port)))
+			p.headers = in.Headers
+			p.in = conn
+			p.name = in.Name
+			enter := t.ready(node, p)
+			t.Unlock()
+			if enter != nil {
+				t.events.push(enter)
+			}
+		case frameWhisper:
+			t.events.push(&Event{Type: EventWhisper, Name: p.name, Node: node, Msg: body})
+		case frameLeave:
+			t.Lock()
+			entered := p.entered
+			p.entered = false
+			t.Unlock()
+			if entered {
+				t.events.push(&Event{Type: EventExit, Name: p.name, Node: node})
+			}
+		}
+	}
+}
+
+func (t *nativeTransport) SetHeader(name, value string) error {
+	t.Lock()
+	defer t.Unlock()
+	t.headers[name] = value
+	return nil
+}
+
+func (t *nativeTransport) Start() error {
+	var ifi *net.Interface
+	var host string
+	if t.adapter != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(t.adapter); err != nil {
+			return err
+		}
+		if host, err = interfaceIP(ifi); err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen("tcp4", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return err
+	}
+	beacon, err := net.ListenMulticastUDP("udp4", ifi, t.group)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(host)})
+	if err != nil {
+		listener.Close()
+		beacon.Close()
+		return err
+	}
+	t.beacon = beacon
+	t.listener = listener
+	t.sender = sender
+	go t.events.pump()
+	go t.accept()
+	go t.receive()
+	go t.announce()
+	return nil
+}
+
+func (t *nativeTransport) Stop() error {
+	close(t.done)
+	// Tell peers this node is leaving instead of waiting for them to notice.
+	t.sender.WriteToUDP(t.beaconPacket(0), t.group)
+	t.sender.Close()
+	t.beacon.Close()
+	t.listener.Close()
+	t.Lock()
+	for node, p := range t.peers {
+		p.close()
+		delete(t.peers, node)
+	}
+	t.Unlock()
+	t.events.stop()
+	return nil
+}
+
+func (t *nativeTransport) UUID() string {
+	return t.uuid
+}
+
+func (t *nativeTransport) Whisper(node string, payload []byte) error {
+	t.Lock()
+	p, ok := t.peers[node]
+	ok = ok && p.entered
+	t.Unlock()
+	if !ok {
+		return newError(errNative, "%s is not a peer", node)
+	}
+	if err := p.write(frameWhisper, payload); err != nil {
+		return newError(errNative, err.Error())
+	}
+	return nil
+}
+
+func interfaceIP(ifi *net.Interface) (string, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ip, ok := addr.(*net.IPNet); ok && ip.IP.To4() != nil {
+			return ip.IP.String(), nil
+		}
+	}
+	return "", newError(errNative, "%s has no IPv4 address", ifi.Name)
+}
+
+func newNative(port int, adapter string) (Transport, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, newError(errInitialize, err.Error())
+	}
+	uuid := strings.ToUpper(hex.EncodeToString(id))
+	return &nativeTransport{
+		Mutex:   new(sync.Mutex),
+		adapter: adapter,
+		done:    make(chan struct{}),
+		events:  newEventQueue(),
+		group:   &net.UDPAddr{IP: net.ParseIP(nativeGroup), Port: port},
+		headers: make(map[string]string),
+		name:    uuid[:6],
+		peers:   make(map[string]*nativePeer),
+		uuid:    uuid,
+	}, nil
+}
+
+func writeFrame(conn net.Conn, kind byte, body []byte) error {
+	frame := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)+1))
+	frame[4] = kind
+	conn.SetWriteDeadline(time.Now().Add(nativeExpiry))
+	_, err := conn.Write(append(frame, body...))
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > nativeMaxFrame {
+		return 0, nil, newError(errNative, "bad frame length %d", length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, nil, err
+	}
+	return frame[0], frame[1:], nil
+}
@@ -0,0 +1,15 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+//go:build !cgo
+// +build !cgo
+
+package sleuth
+
+// Without cgo there is no libzmq, so the native transport is the default.
+const defaultBackend = "native"
+
+func newGyre(port int, adapter string) (Transport, error) {
+	return nil, newError(errBackend, "the gyre backend requires cgo")
+}
@@ -6,28 +6,45 @@ package sleuth
 
 import "sync"
 
+// notifier broadcasts to any number of waiting goroutines that services have
+// been added. Each notification closes the channel that waiters are waiting
+// on and replaces it, so that no waiter can be missed or block the notifier.
 type notifier struct {
 	*sync.Mutex
-	active bool
-	stream chan struct{}
+	changed chan struct{}
+	closed  bool
+	done    chan struct{} // closed when the client is closed
 }
 
-func (n *notifier) activate() {
+func (n *notifier) close() {
 	n.Lock()
 	defer n.Unlock()
-	n.active = true
+	if !n.closed {
+		n.closed = true
+		close(n.done)
+	}
 }
 
-func (n *notifier) deactivate() {
+func (n *notifier) notify() {
 	n.Lock()
 	defer n.Unlock()
-	n.active = false
+	close(n.changed)
+	n.changed = make(chan struct{})
 }
 
-func (n *notifier) notify() {
+// wait returns a channel that is closed by the next notification. A waiter
+// gets the channel before checking for services so that it cannot miss an
+// addition made after its check.
+func (n *notifier) wait() <-chan struct{} {
 	n.Lock()
 	defer n.Unlock()
-	if n.active {
-		n.stream <- struct{}{}
+	return n.changed
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		Mutex:   new(sync.Mutex),
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 }
@@ -4,15 +4,63 @@
 
 package sleuth
 
+import "time"
+
+// metadata is the prefix of the headers that carry a service's metadata.
+const metadata = "meta-"
+
+// PeerInfo describes a peer on the sleuth network that offers a service.
+type PeerInfo struct {
+	// Metadata is the custom metadata the service advertises (see
+	// Config.Metadata).
+	Metadata map[string]string
+	// Name is the short public name of the peer.
+	Name string
+	// Node is the full node UUID of the peer.
+	Node string
+	// Seen is when the client first saw the peer.
+	Seen time.Time
+	// Service is the name of the service the peer offers.
+	Service string
+	// Version is the version of the service the peer offers.
+	Version string
+	// Weight is the weight the peer advertises for load-balancing.
+	Weight int
+}
+
 // peer describes the location of a peer on the sleuth network and the service,
 // if any, that it offers.
 type peer struct {
+	// breaker tracks the failures of requests to a peer.
+	breaker *breaker
+	// metadata is the custom metadata advertised by a peer's service.
+	metadata map[string]string
 	// name is the short public name attached to all events/peers.
 	name string
 	// node is the full peer node name used for whispering.
 	node string
+	// seen is when a peer was first seen.
+	seen time.Time
 	// service is the name of the service being offered by a peer.
 	service string
 	// version is the optional service version running on a peer.
 	version string
+	// weight is the relative share of weighted requests a peer receives.
+	weight int
+}
+
+func (p *peer) info() PeerInfo {
+	info := PeerInfo{
+		Metadata: make(map[string]string, len(p.metadata)),
+		Name:     p.name,
+		Node:     p.node,
+		Seen:     p.seen,
+		Service:  p.service,
+		Version:  p.version,
+		Weight:   p.weight,
+	}
+	for key, value := range p.metadata {
+		info.Metadata[key] = value
+	}
+	return info
 }
@@ -4,19 +4,26 @@
 
 package sleuth
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
 
 type pool struct {
 	*sync.Mutex
 	workers map[string]*workers // map[service-type]service-workers
 }
 
-func (p *pool) add(service string) {
+// add creates the workers of a service, if they do not exist, and reports
+// whether it did.
+func (p *pool) add(service string) bool {
 	p.Lock()
 	defer p.Unlock()
 	if p.workers[service] == nil {
 		p.workers[service] = newWorkers()
+		return true
 	}
+	return false
 }
 
 func (p *pool) get(service string) (*workers, bool) {
@@ -26,6 +33,29 @@ func (p *pool) get(service string) (*workers, bool) {
 	return w, ok
 }
 
+// names returns the sorted names of every service in the pool.
+func (p *pool) names() []string {
+	p.Lock()
+	defer p.Unlock()
+	names := make([]string, 0, len(p.workers))
+	for service := range p.workers {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// peers returns every peer offering a service.
+func (p *pool) peers() []*peer {
+	p.Lock()
+	defer p.Unlock()
+	var peers []*peer
+	for _, w := range p.workers {
+		peers = append(peers, w.all()...)
+	}
+	return peers
+}
+
 func (p *pool) remove(service string) {
 	p.Lock()
 	defer p.Unlock()
@@ -0,0 +1,73 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import "sync"
+
+// queue runs the handlers of incoming requests on a fixed number of
+// goroutines. Requests that arrive while every goroutine is busy wait in the
+// queue, and requests that arrive while the queue is full are rejected. A nil
+// queue runs every handler in a goroutine of its own.
+type queue struct {
+	jobs  chan func()
+	once  *sync.Once
+	slots chan struct{} // holds a slot for each running or waiting request
+	stop  chan struct{}
+}
+
+func (q *queue) close() {
+	if q != nil {
+		q.once.Do(func() { close(q.stop) })
+	}
+}
+
+// push runs a job or queues it, and returns false if the queue is full.
+func (q *queue) push(job func()) bool {
+	if q == nil {
+		go job()
+		return true
+	}
+	select {
+	case q.slots <- struct{}{}:
+		q.jobs <- job
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *queue) run() {
+	for {
+		select {
+		case job := <-q.jobs:
+			job()
+			<-q.slots
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// newQueue returns a queue with the given number of goroutines and the given
+// number of requests that can wait for them, or nil if concurrency is not
+// limited.
+func newQueue(concurrency, depth int) *queue {
+	if concurrency < 1 {
+		return nil
+	}
+	if depth < 0 {
+		depth = 0
+	}
+	q := &queue{
+		jobs:  make(chan func(), concurrency+depth),
+		once:  new(sync.Once),
+		slots: make(chan struct{}, concurrency+depth),
+		stop:  make(chan struct{}),
+	}
+	for i := 0; i < concurrency; i++ {
+		go q.run()
+	}
+	return q
+}
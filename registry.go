@@ -0,0 +1,125 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// challenge is the nonce a node has been asked to return in order to prove
+// that it belongs to the group.
+type challenge struct {
+	event  *Event // the enter event of the node, once it has arrived
+	nonce  string
+	proven bool
+}
+
+// registry holds the services a client offers and the members of its group.
+// Because headers cannot change once a node has started, services registered
+// or unregistered at runtime are announced to every member (ANNC command),
+// including members that enter later. If the group has a key, nodes only
+// become members once they have answered a challenge.
+type registry struct {
+	*sync.Mutex
+	challenges map[string]*challenge   // map[node-uuid]challenge
+	changed    bool                    // services changed since the node started
+	draining   bool                    // no services are announced once draining
+	handlers   map[string]http.Handler // map[service-type]handler
+	members    map[string]*Event       // map[node-uuid]enter-event
+	primary    string                  // service advertised in the type header
+	versions   map[string]string       // map[service-type]version
+}
+
+// announcement returns the message that announces the offered services. A
+// draining client announces none, so that peers stop sending it requests, but
+// it still serves the requests that arrive before they find out. The caller
+// must hold the lock.
+func (r *registry) announcement(group string) ([]byte, error) {
+	versions := r.versions
+	if r.draining {
+		versions = map[string]string{}
+	}
+	marshalled, err := json.Marshal(versions)
+	if err != nil {
+		return nil, newError(errANNC, err.Error())
+	}
+	return append([]byte(group+annc), zip(marshalled)...), nil
+}
+
+// caller returns the identity of a member that has sent a request.
+func (r *registry) caller(node string) Caller {
+	r.Lock()
+	defer r.Unlock()
+	caller := Caller{Node: node}
+	if event, ok := r.members[node]; ok {
+		caller.Name = event.Name
+		caller.Service = event.Headers["type"]
+		caller.Version = event.Headers["version"]
+	}
+	return caller
+}
+
+// heard reports whether a node is a member or has at least proven that it
+// belongs to the group while its enter event is still on the way.
+func (r *registry) heard(node string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.members[node]; ok {
+		return true
+	}
+	pending, ok := r.challenges[node]
+	return ok && pending.proven
+}
+
+func (r *registry) leave(node string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.challenges, node)
+	delete(r.members, node)
+}
+
+func (r *registry) member(node string) (*Event, bool) {
+	r.Lock()
+	defer r.Unlock()
+	event, ok := r.members[node]
+	return event, ok
+}
+
+// refresh replaces the enter event of a member whose services have changed.
+func (r *registry) refresh(event *Event) {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.members[event.Node]; ok {
+		r.members[event.Node] = event
+	}
+}
+
+// route returns the service a request is for and its handler. Requests from
+// peers that do not name a service go to the service in the type header, and
+// requests for services that are not offered are not found.
+func (r *registry) route(service string) (string, http.Handler) {
+	r.Lock()
+	defer r.Unlock()
+	if service == "" {
+		service = r.primary
+	}
+	handler, ok := r.handlers[service]
+	if !ok {
+		return service, http.NotFoundHandler()
+	}
+	return service, handler
+}
+
+func newRegistry() *registry {
+	return &registry{
+		Mutex:      new(sync.Mutex),
+		challenges: make(map[string]*challenge),
+		handlers:   make(map[string]http.Handler),
+		members:    make(map[string]*Event),
+		versions:   make(map[string]string),
+	}
+}
@@ -7,8 +7,10 @@ package sleuth
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 type request struct {
@@ -17,30 +19,63 @@ type request struct {
 	Handle      string              `json:"handle"`
 	Header      map[string][]string `json:"header"`
 	Method      string              `json:"method"`
-	URL         string              `json:"url"`
+	// Service is the service the request is addressed to, so that a peer
+	// offering more than one service can route it to the right handler.
+	Service string `json:"service,omitempty"`
+	// Stream is set if the body is too large to send inline and follows the
+	// request in chunks.
+	Stream bool `json:"stream,omitempty"`
+	// Timeout is the time remaining before the request's deadline. It is sent
+	// as a duration instead of a timestamp so that peers need not share a clock.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	URL     string        `json:"url"`
 }
 
-func reqMarshal(group, dest, handle string, in *http.Request) ([]byte, error) {
+// reqMarshal returns the marshalled request and, if the request body is too
+// large to send inline, the remainder of the body that needs to be streamed.
+func reqMarshal(group, dest, handle string, in *http.Request) ([]byte, io.ReadCloser, error) {
 	out := &request{
 		Destination: dest,
 		Handle:      handle,
 		Header:      map[string][]string(in.Header),
 		Method:      in.Method,
+		Service:     in.URL.Host,
 	}
+	if deadline, ok := in.Context().Deadline(); ok {
+		out.Timeout = deadline.Sub(time.Now())
+	}
+	var upload io.ReadCloser
 	if in.Body != nil {
-		if body, err := ioutil.ReadAll(in.Body); err == nil {
+		body, err := ioutil.ReadAll(io.LimitReader(in.Body, chunkSize+1))
+		if err != nil {
+			in.Body.Close()
+			return nil, nil, newError(errReqMarshal, err.Error())
+		}
+		if len(body) > chunkSize {
+			out.Stream = true
+			upload = &readCloser{
+				Reader: io.MultiReader(bytes.NewReader(body), in.Body),
+				Closer: in.Body,
+			}
+		} else {
 			out.Body = body
+			in.Body.Close()
 		}
 	}
 	// Scheme and Host are used by sleuth for routing, but should not be sent.
-	in.URL.Scheme = ""
-	in.URL.Host = ""
-	out.URL = in.URL.String()
+	// They are removed from a copy because the caller still owns the request.
+	url := *in.URL
+	url.Scheme = ""
+	url.Host = ""
+	out.URL = url.String()
 	marshalled, err := json.Marshal(out)
 	if err != nil {
-		return nil, newError(errReqMarshal, err.Error())
+		if upload != nil {
+			upload.Close()
+		}
+		return nil, nil, newError(errReqMarshal, err.Error())
 	}
-	return append([]byte(group+repl), zip(marshalled)...), nil
+	return append([]byte(group+repl), zip(marshalled)...), upload, nil
 }
 
 func reqUnmarshal(group string, p []byte) (*destination, *http.Request, error) {
@@ -61,5 +96,10 @@ func reqUnmarshal(group string, p []byte) (*destination, *http.Request, error) {
 	dest.group = group
 	dest.handle = in.Handle
 	dest.node = in.Destination
+	dest.service = in.Service
+	dest.stream = in.Stream
+	if in.Timeout != 0 {
+		dest.deadline = time.Now().Add(in.Timeout)
+	}
 	return dest, out, nil
 }
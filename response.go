@@ -7,6 +7,7 @@ package sleuth
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 )
@@ -16,6 +17,8 @@ type response struct {
 	Code   int         `json:"code"`
 	Handle string      `json:"handle"`
 	Header http.Header `json:"header"`
+	// Stream is set if the body follows the response in chunks.
+	Stream bool `json:"stream,omitempty"`
 }
 
 type body struct {
@@ -24,12 +27,19 @@ type body struct {
 
 func (*body) Close() error { return nil }
 
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 func resMarshal(group string, res *response) []byte {
 	// This will never fail to marshal, so error can be ignored.
 	marshalled, _ := json.Marshal(res)
 	return append([]byte(group+recv), zip(marshalled)...)
 }
 
+// resUnmarshal returns the handle and the response in a payload. If the body of
+// the response is streamed, its ContentLength is -1 and its Body is nil.
 func resUnmarshal(p []byte) (string, *http.Response, error) {
 	var handle string
 	var res *http.Response
@@ -44,10 +54,17 @@ func resUnmarshal(p []byte) (string, *http.Response, error) {
 	}
 	handle = in.Handle
 	res = new(http.Response)
-	res.Body = &body{bytes.NewBuffer(in.Body)}
-	res.ContentLength = int64(len(in.Body))
+	if in.Stream {
+		res.ContentLength = -1
+	} else {
+		res.Body = &body{bytes.NewBuffer(in.Body)}
+		res.ContentLength = int64(len(in.Body))
+	}
 	res.Header = in.Header
+	res.Proto = "HTTP/1.1"
+	res.ProtoMajor = 1
+	res.ProtoMinor = 1
 	res.StatusCode = in.Code
-	res.Status = http.StatusText(in.Code)
+	res.Status = fmt.Sprintf("%d %s", in.Code, http.StatusText(in.Code))
 	return handle, res, nil
 }
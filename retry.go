@@ -0,0 +1,69 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"net/http"
+	"time"
+)
+
+// RetryPolicy describes when a client re-sends a request that has failed
+// because its peer timed out or could not be reached. Each retry goes to a
+// different peer offering the same service, if there is one.
+type RetryPolicy struct {
+	// Attempts is the maximum number of times a request is sent, including the
+	// first time. Values less than 2 disable retries.
+	Attempts int
+
+	// Backoff is the delay before the first retry. It doubles for each retry
+	// after that.
+	Backoff time.Duration
+
+	// Budget is the maximum total time spent on a request, after which it is
+	// not retried again. If it is zero, only Attempts limits retries.
+	Budget time.Duration
+
+	// Methods are the idempotent methods that can be retried. If it is nil,
+	// DELETE, GET, HEAD, OPTIONS, PUT, and TRACE requests are retried.
+	Methods []string
+}
+
+var idempotent = []string{"DELETE", "GET", "HEAD", "OPTIONS", "PUT", "TRACE"}
+
+// attempts returns the number of times a request may be sent. Requests whose
+// bodies cannot be read again (i.e., their GetBody is nil) are only sent once.
+func (r *RetryPolicy) attempts(req *http.Request) int {
+	if r == nil || r.Attempts < 2 {
+		return 1
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return 1
+	}
+	methods := r.Methods
+	if methods == nil {
+		methods = idempotent
+	}
+	for _, method := range methods {
+		if method == req.Method {
+			return r.Attempts
+		}
+	}
+	return 1
+}
+
+// backoff returns the delay before a retry, where retry 1 is the second attempt.
+func (r *RetryPolicy) backoff(retry int) time.Duration {
+	return r.Backoff << uint(retry-1)
+}
+
+// retriable reports whether a failed attempt might succeed on another peer.
+func retriable(err *Error) bool {
+	switch err.Codes[0] {
+	case errReqWhisper, errTimeout:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// replayWindow is how many of the latest sequence numbers of a sender are
+// remembered. Messages that fall further behind are rejected as replays.
+const replayWindow = 1024
+
+// sealer encrypts and authenticates the messages peers whisper to one another
+// with AES-256-GCM, using a key derived from the secret the group shares. The
+// group, sending node, and receiving node of a message are authenticated along
+// with it, so that it cannot be passed off to, or as if from, another node.
+// Each message also carries a sequence number under the encryption, and a
+// receiver rejects any number it has already seen from the sender, so that a
+// captured message cannot be replayed. It also signs the headers a node
+// announces with HMAC-SHA256, using another key derived from the secret, so
+// that peers can tell the node belongs.
+type sealer struct {
+	*sync.Mutex
+	aead     cipher.AEAD
+	group    string
+	mac      []byte
+	received map[string]*sequences // map[node-uuid]sequences, kept on exit
+	sequence uint64                // last sequence number sent to any node
+}
+
+// data returns the additional authenticated data of a message.
+func (s *sealer) data(from, to string) []byte {
+	return []byte(s.group + "\x00" + from + "\x00" + to)
+}
+
+// nonce returns a random challenge for a node to return sealed with the key.
+func (s *sealer) nonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", newError(errChallenge, err.Error())
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// open returns a sealed message with its action and body decrypted. Messages
+// that were not sealed with the key of the group, or that have been received
+// before, are rejected.
+func (s *sealer) open(from, to string, payload []byte) ([]byte, error) {
+	size := len(s.group) + s.aead.NonceSize()
+	if len(payload) < size {
+		return nil, newError(errSeal, "unsealed message from %s", from)
+	}
+	nonce, sealed := payload[len(s.group):size], payload[size:]
+	opened, err := s.aead.Open(nil, nonce, sealed, s.data(from, to))
+	if err != nil || len(opened) < 8 {
+		return nil, newError(errSeal, "unauthenticated message from %s", from)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.received[from]; !ok {
+		s.received[from] = new(sequences)
+	}
+	if !s.received[from].accept(binary.BigEndian.Uint64(opened)) {
+		return nil, newError(errSeal, "replayed message from %s", from)
+	}
+	return append([]byte(s.group), opened[8:]...), nil
+}
+
+// seal returns a message with its action and body encrypted. The group header
+// is left in the clear so that peers can tell which group a message is for.
+func (s *sealer) seal(from, to string, payload []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, newError(errSeal, err.Error())
+	}
+	s.Lock()
+	s.sequence++
+	plain := make([]byte, 8, 8+len(payload)-len(s.group))
+	binary.BigEndian.PutUint64(plain, s.sequence)
+	s.Unlock()
+	plain = append(plain, payload[len(s.group):]...)
+	sealed := append([]byte(s.group), nonce...)
+	return s.aead.Seal(sealed, nonce, plain, s.data(from, to)), nil
+}
+
+// sign returns the signature of the headers of a node, except the signature
+// header itself.
+func (s *sealer) sign(headers map[string]string) string {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		if key != "signature" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	mac := hmac.New(sha256.New, s.mac)
+	for _, key := range keys {
+		// Lengths are written first so that no two sets of headers are alike.
+		for _, field := range []string{key, headers[key]} {
+			mac.Write([]byte(strconv.Itoa(len(field)) + ":" + field))
+		}
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify reports whether a node that has entered the network signed its
+// headers, including its own identifier, with the key of the group.
+func (s *sealer) verify(event *Event) bool {
+	if event.Headers["node"] != event.Node {
+		return false
+	}
+	signature := []byte(event.Headers["signature"])
+	return hmac.Equal(signature, []byte(s.sign(event.Headers)))
+}
+
+// sequences holds the sequence numbers a node has received from a sender within
+// the replay window. A sender numbers the messages it sends to every node in
+// one sequence, so a receiver sees gaps, and concurrent messages can arrive out
+// of order, but each number arrives at most once.
+type sequences struct {
+	bits    [replayWindow / 64]uint64
+	highest uint64
+}
+
+// accept records a sequence number and reports whether it is new. Numbers that
+// are too old to tell are not.
+func (w *sequences) accept(sequence uint64) bool {
+	if sequence == 0 || sequence+replayWindow <= w.highest {
+		return false
+	}
+	words := uint64(len(w.bits))
+	if sequence > w.highest {
+		// Bits are reused as the window moves, so the ones it passes are cleared.
+		from := w.highest + 1
+		if sequence-w.highest > replayWindow {
+			from = sequence - replayWindow + 1
+		}
+		for n := from; n <= sequence; n++ {
+			w.bits[n/64%words] &^= 1 << (n % 64)
+		}
+		w.highest = sequence
+	}
+	word, bit := sequence/64%words, uint64(1)<<(sequence%64)
+	if w.bits[word]&bit != 0 {
+		return false
+	}
+	w.bits[word] |= bit
+	return true
+}
+
+// sealedTransport seals every message its transport whispers.
+type sealedTransport struct {
+	Transport
+	sealer *sealer
+}
+
+// Whisper allows sealedTransport to conform to the Transport interface.
+func (t *sealedTransport) Whisper(node string, payload []byte) error {
+	sealed, err := t.sealer.seal(t.UUID(), node, payload)
+	if err != nil {
+		return err
+	}
+	return t.Transport.Whisper(node, sealed)
+}
+
+// newSealer returns a sealer for a group's shared secret, or nil if the group
+// has none.
+func newSealer(group, key string) (*sealer, error) {
+	if key == "" {
+		return nil, nil
+	}
+	derived := sha256.Sum256([]byte(key))
+	signer := hmac.New(sha256.New, []byte(key))
+	signer.Write([]byte("sleuth headers"))
+	block, err := aes.NewCipher(derived[:])
+	if err != nil {
+		return nil, newError(errSeal, err.Error())
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, newError(errSeal, err.Error())
+	}
+	return &sealer{
+		Mutex:    new(sync.Mutex),
+		aead:     aead,
+		group:    group,
+		mac:      signer.Sum(nil),
+		received: make(map[string]*sequences),
+	}, nil
+}
@@ -11,44 +11,95 @@
 package sleuth
 
 import (
+	"encoding/json"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/ursiform/logger"
-	"github.com/zeromq/gyre"
 )
 
 const (
+	annc   = "ANNC"
+	chal   = "CHAL"
+	data   = "DATA"
+	flow   = "FLOW"
 	group  = "SLEUTH-v1"
 	port   = 5670
+	prov   = "PROV"
 	recv   = "RECV"
 	repl   = "REPL"
 	scheme = "sleuth"
 )
 
 type connection struct {
-	adapter string
-	group   string
-	handler http.Handler
-	name    string
-	node    string
-	port    int
-	server  bool
-	version string
+	adapter   string
+	backend   string
+	group     string
+	handlers  map[string]http.Handler // map[service-type]handler
+	metadata  map[string]string
+	name      string
+	node      string
+	port      int
+	sealer    *sealer
+	server    bool
+	services  map[string]string // map[service-type]version
+	transport Transport
+	version   string
+	weight    int
 }
 
-func dispatch(client *Client, event *gyre.Event) (err error) {
-	name := event.Name()
-	switch event.Type() {
-	case gyre.EventEnter:
-		group, _ := event.Header("group")
-		node, _ := event.Header("node")
-		service, _ := event.Header("type")
-		version, _ := event.Header("version")
-		err = client.add(group, name, node, service, version)
-	case gyre.EventExit, gyre.EventLeave:
-		client.remove(name)
-	case gyre.EventWhisper:
-		err = client.dispatch(event.Msg())
+// advertised returns a peer for each service offered by a node that has
+// entered the network. Nodes advertise all of their services in the services
+// header, but the type and version headers suffice for a single service.
+func advertised(event *Event) ([]*peer, error) {
+	services := make(map[string]string)
+	if service, ok := event.Headers["type"]; ok {
+		services[service] = event.Headers["version"]
+	}
+	if header, ok := event.Headers["services"]; ok {
+		services = nil
+		if err := json.Unmarshal([]byte(header), &services); err != nil {
+			return nil, newError(errServicesHeader, err.Error())
+		}
+	}
+	// Peers that do not advertise a valid weight have the default weight.
+	weight, _ := strconv.Atoi(event.Headers["weight"])
+	meta := make(map[string]string)
+	for header, value := range event.Headers {
+		if strings.HasPrefix(header, metadata) {
+			meta[strings.TrimPrefix(header, metadata)] = value
+		}
+	}
+	var peers []*peer
+	for service, version := range services {
+		peers = append(peers, &peer{
+			metadata: meta,
+			name:     event.Name,
+			node:     event.Headers["node"],
+			service:  service,
+			version:  version,
+			weight:   weight,
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].service < peers[j].service
+	})
+	return peers, nil
+}
+
+func dispatch(client *Client, event *Event) (err error) {
+	switch event.Type {
+	case EventEnter:
+		err = client.enter(event)
+	case EventExit:
+		client.limiter.forget(event.Node)
+		client.registry.leave(event.Node)
+		client.remove(event.Name)
+		client.streams.drop(event.Node)
+	case EventWhisper:
+		err = client.dispatch(event.Node, event.Msg)
 	}
 	if err != nil {
 		err.(*Error).escalate(errDispatch)
@@ -57,35 +108,65 @@ func dispatch(client *Client, event *gyre.Event) (err error) {
 }
 
 func listen(client *Client) {
-	for {
-		if err := dispatch(client, <-client.node.Events()); err != nil {
+	for event := range client.node.Events() {
+		if err := dispatch(client, event); err != nil {
 			client.log.Error(err.Error())
 		}
 	}
 }
 
-func newNode(conn *connection, log *logger.Logger) (*gyre.Gyre, error) {
-	node, err := gyre.New()
-	if err != nil {
-		return nil, newError(errInitialize, err.Error())
+func newNode(conn *connection, log *logger.Logger) (Transport, error) {
+	node := conn.transport
+	if node == nil {
+		var err error
+		switch conn.backend {
+		case "gyre":
+			node, err = newGyre(conn.port, conn.adapter)
+		case "native":
+			node, err = newNative(conn.port, conn.adapter)
+		default:
+			err = newError(errBackend, "backend \"%s\" is unknown", conn.backend)
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
-	if err := node.SetPort(conn.port); err != nil {
-		return nil, newError(errPort, err.Error())
+	// If the group has a key, every message the node whispers is sealed.
+	if conn.sealer != nil {
+		node = &sealedTransport{Transport: node, sealer: conn.sealer}
 	}
-	if conn.adapter != "" {
-		if err := node.SetInterface(conn.adapter); err != nil {
-			return nil, newError(errInterface, err.Error())
+	// Every node advertises its group, so that its members can be told about
+	// services it registers later. If announcing a service, add service headers.
+	errors := []int{errGroupHeader, errNodeHeader, errWeightHeader}
+	values := []string{conn.group, node.UUID(), strconv.Itoa(conn.weight)}
+	headers := []string{"group", "node", "weight"}
+	if conn.server {
+		services, err := json.Marshal(conn.services)
+		if err != nil {
+			return nil, newError(errServicesHeader, err.Error())
 		}
+		errors = append(errors, errServiceHeader, errVersionHeader, errServicesHeader)
+		values = append(values, conn.name, conn.version, string(services))
+		headers = append(headers, "type", "version", "services")
 	}
-	// If announcing a service, add service headers.
-	if conn.server {
-		errors := [...]int{
-			errGroupHeader, errNodeHeader, errServiceHeader, errVersionHeader}
-		values := [...]string{conn.group, node.UUID(), conn.name, conn.version}
-		for i, header := range [...]string{"group", "node", "type", "version"} {
-			if err := node.SetHeader(header, values[i]); err != nil {
-				return nil, newError(errors[i], err.Error())
-			}
+	signed := make(map[string]string)
+	for i, header := range headers {
+		if err := node.SetHeader(header, values[i]); err != nil {
+			return nil, newError(errors[i], err.Error())
+		}
+		signed[header] = values[i]
+	}
+	for key, value := range conn.metadata {
+		if err := node.SetHeader(metadata+key, value); err != nil {
+			return nil, newError(errMetadataHeader, err.Error())
+		}
+		signed[metadata+key] = value
+	}
+	// If the group has a key, the node proves that it belongs by signing its
+	// headers with it.
+	if conn.sealer != nil {
+		if err := node.SetHeader("signature", conn.sealer.sign(signed)); err != nil {
+			return nil, newError(errSignatureHeader, err.Error())
 		}
 	}
 	if err := node.Start(); err != nil {
@@ -97,7 +178,12 @@ func newNode(conn *connection, log *logger.Logger) (*gyre.Gyre, error) {
 	}
 	var role string
 	if conn.server {
-		role = conn.name
+		names := make([]string, 0, len(conn.services))
+		for name := range conn.services {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		role = strings.Join(names, ",")
 	} else {
 		role = "client-only"
 	}
@@ -107,20 +193,68 @@ func newNode(conn *connection, log *logger.Logger) (*gyre.Gyre, error) {
 
 // New is the entry point to the sleuth package. It returns a reference to a
 // Client object that has joined the local network. If the config argument is
-// nil, sleuth will use sensible defaults. If the Handler attribute of the
-// config object is not set, sleuth will operate in client-only mode.
+// nil, sleuth will use sensible defaults. If neither the Handler nor the
+// Services attribute of the config object is set, sleuth will operate in
+// client-only mode.
 func New(config *Config) (*Client, error) {
 	// Sanitize the configuration object.
 	config = initConfig(config)
 	// Ignore errors because log level is guaranteed to be correct in initConfig.
 	log, _ := logger.New(config.logLevel)
-	conn := &connection{group: config.group}
-	if conn.server = config.Handler != nil; conn.server {
-		conn.handler = config.Handler
-		conn.name = config.Service
-		if conn.name == "" {
+	for _, strategy := range config.Balancers {
+		if _, ok := strategies[strategy]; !ok {
+			err := newError(errBalancer, "%s is an unknown balancer", strategy)
+			return nil, err.escalate(errNew)
+		}
+	}
+	if _, ok := strategies[config.Balancer]; !ok {
+		err := newError(errBalancer, "%s is an unknown balancer", config.Balancer)
+		return nil, err.escalate(errNew)
+	}
+	if config.CallerLimit != nil && !(config.CallerLimit.Rate > 0) {
+		err := newError(errLimit, "caller limit rate must be greater than zero")
+		return nil, err.escalate(errNew)
+	}
+	for service, limit := range config.ServiceLimits {
+		if !(limit.Rate > 0) {
+			err := newError(errLimit, "%s limit rate must be greater than zero", service)
+			return nil, err.escalate(errNew)
+		}
+	}
+	conn := &connection{
+		backend:  config.Backend,
+		group:    config.group,
+		handlers: make(map[string]http.Handler),
+		services: make(map[string]string),
+	}
+	if config.Handler != nil {
+		if config.Service == "" {
 			return nil, newError(errService, "config.Service not defined")
 		}
+		conn.handlers[config.Service] = config.Handler
+		conn.services[config.Service] = config.Version
+	}
+	for name, service := range config.Services {
+		if _, ok := conn.handlers[name]; ok || name == "" || service.Handler == nil {
+			return nil, newError(errService, "config.Services[\"%s\"] is invalid", name)
+		}
+		conn.handlers[name] = service.Handler
+		conn.services[name] = service.Version
+	}
+	if conn.server = len(conn.handlers) > 0; conn.server {
+		// The type and version headers advertise the service of Config.Service
+		// or, if there is none, the first of Config.Services by name.
+		conn.name = config.Service
+		for name := range conn.services {
+			if config.Handler == nil && (conn.name == "" || name < conn.name) {
+				conn.name = name
+			}
+		}
+		for name, version := range conn.services {
+			if version == "" {
+				conn.services[name] = "unknown"
+			}
+		}
 	} else {
 		log.Init("sleuth: config.Handler is nil, client-only mode")
 	}
@@ -130,15 +264,31 @@ func New(config *Config) (*Client, error) {
 	if conn.port = config.Port; conn.port == 0 {
 		conn.port = port
 	}
-	if conn.version = config.Version; conn.version == "" {
-		conn.version = "unknown"
+	conn.version = conn.services[conn.name]
+	conn.transport = config.Transport
+	sealer, err := newSealer(config.group, config.Key)
+	if err != nil {
+		return nil, err.(*Error).escalate(errNew)
 	}
+	conn.sealer = sealer
+	conn.metadata = config.Metadata
+	conn.weight = config.Weight
 	node, err := newNode(conn, log)
 	if err != nil {
 		return nil, err.(*Error).escalate(errNew)
 	}
 	client := newClient(config.group, node, log)
-	client.handler = conn.handler
+	client.registry.handlers = conn.handlers
+	client.registry.primary = conn.name
+	client.registry.versions = conn.services
+	client.admission = config.Admission
+	client.balancer = config.Balancer
+	client.limiter = newLimiter(config.CallerLimit, config.ServiceLimits)
+	client.sealer = conn.sealer
+	client.queue = newQueue(config.Concurrency, config.Queue)
+	for service, strategy := range config.Balancers {
+		client.balancers[service] = strategy
+	}
 	go listen(client)
 	return client, nil
 }
@@ -6,9 +6,18 @@ package sleuth
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -35,6 +44,45 @@ func (g *goodWhisperer) Whisper(addr string, payload []byte) error {
 	return nil
 }
 
+// recordWhisperer keeps every payload it is asked to whisper.
+type recordWhisperer struct {
+	payloads [][]byte
+}
+
+// Whisper allows recordWhisperer to conform to the whisperer interface. It
+// succeeds every time.
+func (r *recordWhisperer) Whisper(addr string, payload []byte) error {
+	r.payloads = append(r.payloads, payload)
+	return nil
+}
+
+// recordTransport is a transport that only whispers, and keeps every payload
+// it is asked to whisper.
+type recordTransport struct {
+	Transport
+	recordWhisperer
+}
+
+// Whisper allows recordTransport to conform to the Transport interface. It
+// succeeds every time.
+func (t *recordTransport) Whisper(node string, payload []byte) error {
+	return t.recordWhisperer.Whisper(node, payload)
+}
+
+// response returns the only response a recordWhisperer has whispered.
+func (r *recordWhisperer) response(t *testing.T) *http.Response {
+	if len(r.payloads) != 1 {
+		t.Errorf("expected 1 whispered response, got %d", len(r.payloads))
+		return nil
+	}
+	_, res, err := resUnmarshal(r.payloads[0][len(GROUP)+len(recv):])
+	if err != nil {
+		t.Errorf("resUnmarshal failed: %s", err.Error())
+		return nil
+	}
+	return res
+}
+
 // echoHandler is the handler for the server in the integration test.
 type echoHandler struct{}
 
@@ -59,12 +107,139 @@ func testCodes(t *testing.T, err error, want []int) {
 	}
 }
 
+// Test balancer.go
+
+func TestBalancerHashed(t *testing.T) {
+	foo := &peer{name: "foo", node: "foo"}
+	list := []*peer{foo, {name: "bar", node: "bar"}, {name: "baz", node: "baz"}}
+	for _, key := range []string{"qux", "quux", "corge", "grault"} {
+		p := hashed(list, key)
+		if p != hashed(list, key) {
+			t.Errorf("expected key %s to be hashed to one peer", key)
+		}
+		// Removing a peer should only move the keys that were hashed to it.
+		if p != foo && p != hashed(list[1:], key) {
+			t.Errorf("expected key %s to stay on %s", key, p.name)
+		}
+	}
+}
+
+func TestBalancerLeast(t *testing.T) {
+	list := []*peer{{node: "foo"}, {node: "bar"}, {node: "baz"}}
+	load := map[string]int{"foo": 2, "bar": 1, "baz": 1}
+	count := func(node string) int { return load[node] }
+	if i := least(list, 0, count); list[i].node != "bar" {
+		t.Errorf("expected least loaded peer to be bar, got %s", list[i].node)
+	}
+	if i := least(list, 2, count); list[i].node != "baz" {
+		t.Errorf("expected tie to go to baz, got %s", list[i].node)
+	}
+}
+
+func TestBalancerTwoChoices(t *testing.T) {
+	list := []*peer{{node: "foo"}, {node: "bar"}}
+	load := map[string]int{"foo": 5}
+	count := func(node string) int { return load[node] }
+	for i := 0; i < 10; i++ {
+		if p := twoChoices(list, count); p.node != "bar" {
+			t.Errorf("expected less loaded peer to be chosen, got %s", p.node)
+		}
+	}
+}
+
+func TestBalancerWeighted(t *testing.T) {
+	list := []*peer{{node: "foo", weight: 0}, {node: "bar", weight: 3}}
+	for i := 0; i < 10; i++ {
+		if p := weighted(list); p.node != "bar" {
+			t.Errorf("expected peer without weight to be skipped, got %s", p.node)
+		}
+	}
+}
+
+// Test breaker.go
+
+func TestBreakerRecord(t *testing.T) {
+	policy := &BreakerPolicy{Cooldown: time.Minute, Failures: 2}
+	b := newBreaker()
+	now := time.Now()
+	b.record(policy, true, now)
+	if _, state, _ := b.info(); state != BreakerClosed {
+		t.Errorf("expected breaker to stay closed after 1 failure, got %s", state)
+	}
+	b.record(policy, true, now)
+	if b.tryAcquire(now) {
+		t.Errorf("expected open breaker to be unavailable")
+	}
+	later := now.Add(policy.Cooldown)
+	if !b.tryAcquire(later) {
+		t.Errorf("expected breaker to be available after its cooldown")
+	}
+	if _, state, _ := b.info(); state != BreakerHalfOpen || b.tryAcquire(later) {
+		t.Errorf("expected half-open breaker to allow a single request")
+	}
+	b.record(policy, true, later)
+	_, state, until := b.info()
+	if state != BreakerOpen || !until.After(later) {
+		t.Errorf("expected failed probe to open breaker again, got %s", state)
+	}
+	b.tryAcquire(until)
+	b.record(policy, false, until)
+	if failures, state, _ := b.info(); state != BreakerClosed || failures != 0 {
+		t.Errorf("expected successful probe to close breaker, got %s", state)
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	policy := &BreakerPolicy{Cooldown: time.Minute, Failures: 1}
+	b := newBreaker()
+	now := time.Now()
+	b.record(policy, true, now)
+	later := now.Add(policy.Cooldown)
+	var probes int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.tryAcquire(later) {
+				atomic.AddInt32(&probes, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if probes != 1 {
+		t.Errorf("expected a single probe of a half-open breaker, got %d", probes)
+	}
+}
+
+// Test caller.go
+
+func TestIdentify(t *testing.T) {
+	if _, ok := CallerFrom(context.Background()); ok {
+		t.Errorf("expected no caller in a background context")
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(CallerHeader, "foo")
+	req.Header.Set(CallerServiceHeader, "bar")
+	caller := Caller{Name: "baz", Node: "qux"}
+	req = identify(req, caller)
+	if got, ok := CallerFrom(req.Context()); !ok || got != caller {
+		t.Errorf("expected caller %v, got %v", caller, got)
+	}
+	if name := req.Header.Get(CallerHeader); name != "baz" {
+		t.Errorf("expected caller header to be replaced, got %s", name)
+	}
+	if _, ok := req.Header[CallerServiceHeader]; ok {
+		t.Errorf("expected caller service header to be removed")
+	}
+}
+
 // Test client.go
 
 func TestClientAddBadMember(t *testing.T) {
 	log, _ := logger.New(logger.Silent)
 	c := newClient(GROUP, nil, log)
-	err := c.add(GROUP, "foo", "bar", "", "")
+	err := c.add(GROUP, &peer{name: "foo", node: "bar"})
 	if err == nil {
 		t.Errorf("expected client dispatch to fail on bad member")
 		return
@@ -89,7 +264,7 @@ func TestClientCloseMultipleError(t *testing.T) {
 func TestClientDispatchBadAction(t *testing.T) {
 	log, _ := logger.New(logger.Silent)
 	c := newClient(GROUP, nil, log)
-	err := c.dispatch([]byte(GROUP + "FAIL"))
+	err := c.dispatch("", []byte(GROUP+"FAIL"))
 	if err == nil {
 		t.Errorf("expected client dispatch to fail on bad action")
 		return
@@ -100,7 +275,7 @@ func TestClientDispatchBadAction(t *testing.T) {
 func TestClientDispatchEmpty(t *testing.T) {
 	log, _ := logger.New(logger.Silent)
 	c := newClient(GROUP, nil, log)
-	err := c.dispatch([]byte{})
+	err := c.dispatch("", []byte{})
 	if err == nil {
 		t.Errorf("expected client dispatch to fail on empty payload")
 		return
@@ -111,7 +286,7 @@ func TestClientDispatchEmpty(t *testing.T) {
 func TestClientDoClosed(t *testing.T) {
 	log, _ := logger.New(logger.Silent)
 	c := newClient(GROUP, nil, log)
-	c.closed = true
+	c.closed = 1
 	req, _ := http.NewRequest("POST", "sleuth://foo/bar", nil)
 	_, err := c.Do(req)
 	if err == nil {
@@ -121,11 +296,82 @@ func TestClientDoClosed(t *testing.T) {
 	testCodes(t, err, []int{errClosed, errDo})
 }
 
+// silentHandler never responds, even once its request is canceled, until it
+// is released.
+type silentHandler struct {
+	release chan struct{}
+}
+
+// ServeHTTP allows silentHandler to conform to the http.Handler interface.
+func (h *silentHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	<-h.release
+}
+
+// hangingClient returns a client that has found a peer offering a service
+// that never responds, so that requests to it can only be abandoned.
+func hangingClient(service string) (*Client, func()) {
+	network := NewMemoryNetwork()
+	handler := &silentHandler{release: make(chan struct{})}
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	server, _ := New(&Config{
+		group:     GROUP,
+		Handler:   handler,
+		Service:   service,
+		Transport: network.Transport(),
+	})
+	client.WaitFor(service)
+	return client, func() {
+		close(handler.release)
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestClientDoCanceled(t *testing.T) {
+	c, closer := hangingClient("foo")
+	defer closer()
+	service := "foo"
+	c.Timeout = time.Second * 10
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("POST", "sleuth://"+service+"/", nil)
+	go func() {
+		<-time.After(time.Millisecond * 10)
+		cancel()
+	}()
+	_, err := c.Do(req.WithContext(ctx))
+	if err == nil {
+		t.Errorf("expected client Do to fail when context is canceled")
+		return
+	}
+	testCodes(t, err, []int{errCanceled})
+	if err.(*Error).Unwrap() != context.Canceled {
+		t.Errorf("expected client Do error to wrap context.Canceled")
+	}
+	if _, ok := c.listener.handles["0"]; ok {
+		t.Errorf("expected canceled handle to be removed")
+	}
+}
+
+func TestClientDoDeadline(t *testing.T) {
+	c, closer := hangingClient("foo")
+	defer closer()
+	service := "foo"
+	c.Timeout = time.Second * 10
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("POST", "sleuth://"+service+"/", nil)
+	_, err := c.Do(req.WithContext(ctx))
+	if err == nil {
+		t.Errorf("expected client Do to fail when deadline is exceeded")
+		return
+	}
+	testCodes(t, err, []int{errDeadline})
+}
+
 func TestClientDoTimeout(t *testing.T) {
-	c, _ := New(&Config{group: GROUP})
-	defer c.Close()
+	c, closer := hangingClient("foo")
+	defer closer()
 	service := "foo"
-	c.add(GROUP, "bar", "baz", service, "")
 	req, _ := http.NewRequest("POST", "sleuth://"+service+"/", nil)
 	_, err := c.Do(req)
 	if err == nil {
@@ -135,6 +381,87 @@ func TestClientDoTimeout(t *testing.T) {
 	testCodes(t, err, []int{errTimeout})
 }
 
+func TestClientDoRetryAttempts(t *testing.T) {
+	c, closer := hangingClient("foo")
+	defer closer()
+	c.Timeout = time.Millisecond * 20
+	c.Retry = &RetryPolicy{Attempts: 3}
+	req, _ := http.NewRequest("GET", "sleuth://foo/", nil)
+	_, err := c.Do(req)
+	if err == nil {
+		t.Errorf("expected client Do to fail after retrying")
+		return
+	}
+	// Every attempt is counted, even though they all went to the same peer.
+	if !strings.Contains(err.Error(), "failed after 3 attempts") {
+		t.Errorf("expected 3 attempts to be reported: %s", err.Error())
+	}
+	testCodes(t, err, []int{errTimeout, errTimeout, errTimeout, errRetry})
+}
+
+func TestClientDoBreaker(t *testing.T) {
+	c, _ := New(&Config{group: GROUP, Transport: NewMemoryNetwork().Transport()})
+	defer c.Close()
+	c.Breaker = &BreakerPolicy{Cooldown: time.Minute, Failures: 1}
+	service := "foo"
+	c.add(GROUP, &peer{name: "bar", node: "baz", service: service})
+	c.add(GROUP, &peer{name: "qux", node: "quux", service: service})
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "sleuth://"+service+"/", nil)
+		if _, err := c.Do(req); err == nil {
+			t.Errorf("expected client Do to fail when no peer can be reached")
+			return
+		}
+	}
+	for _, info := range c.Breakers() {
+		if info.State != BreakerOpen || info.Service != service {
+			t.Errorf("expected breaker of %s to be open, got %s", info.Name, info.State)
+		}
+	}
+	req, _ := http.NewRequest("GET", "sleuth://"+service+"/", nil)
+	_, err := c.Do(req)
+	if err == nil {
+		t.Errorf("expected client Do to fail when every peer is ejected")
+		return
+	}
+	testCodes(t, err, []int{errBreaker})
+}
+
+func TestClientDoRetry(t *testing.T) {
+	c, _ := New(&Config{group: GROUP, Transport: NewMemoryNetwork().Transport()})
+	defer c.Close()
+	c.Retry = &RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+	service := "foo"
+	c.add(GROUP, &peer{name: "bar", node: "baz", service: service})
+	c.add(GROUP, &peer{name: "qux", node: "quux", service: service})
+	req, _ := http.NewRequest("GET", "sleuth://"+service+"/", nil)
+	_, err := c.Do(req)
+	if err == nil {
+		t.Errorf("expected client Do to fail when no peer can be reached")
+		return
+	}
+	testCodes(t, err, []int{errReqWhisper, errReqWhisper, errReqWhisper, errRetry})
+	// Requests with methods that are not idempotent are not retried.
+	req, _ = http.NewRequest("POST", "sleuth://"+service+"/", nil)
+	if _, err = c.Do(req); err != nil {
+		testCodes(t, err, []int{errReqWhisper})
+	}
+}
+
+func TestClientDoUnknownBalancer(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	c.add(GROUP, &peer{name: "bar", node: "baz", service: "foo"})
+	req, _ := http.NewRequest("POST", "sleuth://foo/bar", nil)
+	req.Header.Set(BalancerHeader, "qux")
+	_, err := c.Do(req)
+	if err == nil {
+		t.Errorf("expected client Do to fail on unknown balancer")
+		return
+	}
+	testCodes(t, err, []int{errBalancer, errDo})
+}
+
 func TestClientDoUnknownScheme(t *testing.T) {
 	log, _ := logger.New(logger.Silent)
 	c := newClient(GROUP, nil, log)
@@ -159,11 +486,132 @@ func TestClientDoUnknownService(t *testing.T) {
 	testCodes(t, err, []int{errUnknownService})
 }
 
+func TestClientEnterSignature(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	node := new(recordTransport)
+	c := newClient(GROUP, node, log)
+	c.sealer, _ = newSealer(GROUP, "foo")
+	headers := map[string]string{"group": GROUP, "node": "bar", "type": "baz"}
+	event := &Event{Type: EventEnter, Name: "qux", Node: "bar", Headers: headers}
+	if err := c.enter(event); err != nil || len(node.payloads) > 0 {
+		t.Errorf("expected unsigned peer to be refused")
+	}
+	headers["signature"] = c.sealer.sign(headers)
+	event.Node = "quux"
+	if err := c.enter(event); err != nil || len(node.payloads) > 0 {
+		t.Errorf("expected peer signed for another node to be refused")
+	}
+	// Signed headers could have been recorded, so a peer is only added once
+	// it has answered a challenge.
+	event.Node = "bar"
+	if err := c.enter(event); err != nil || len(c.Services()) > 0 {
+		t.Errorf("expected signed peer to be challenged before it is added")
+	}
+	if err := c.enter(event); err != nil || len(node.payloads) != 1 {
+		t.Errorf("expected signed peer to be challenged once")
+		return
+	}
+	nonce := node.payloads[0][len(GROUP)+len(chal):]
+	if err := c.proven("bar", []byte("baz")); err == nil {
+		t.Errorf("expected wrong answer to be rejected")
+	} else {
+		testCodes(t, err, []int{errChallenge})
+	}
+	if err := c.proven("bar", nonce); err != nil || len(c.Services()) != 1 {
+		t.Errorf("expected signed peer that answered to be added")
+	}
+	if err := c.proven("bar", nonce); err == nil {
+		t.Errorf("expected repeated answer to be rejected")
+	}
+}
+
+func TestClientChallengeBeforeEnter(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	node := new(recordTransport)
+	c := newClient(GROUP, node, log)
+	c.sealer, _ = newSealer(GROUP, "foo")
+	// A peer that challenges the client before it has entered is challenged
+	// first, and answered after.
+	if err := c.prove("bar", []byte("baz")); err != nil {
+		t.Errorf("prove failed: %s", err.Error())
+		return
+	}
+	if len(node.payloads) != 2 ||
+		string(node.payloads[0][len(GROUP):len(GROUP)+len(chal)]) != chal ||
+		string(node.payloads[1]) != GROUP+prov+"baz" {
+		t.Errorf("expected a challenge followed by an answer, got %q", node.payloads)
+		return
+	}
+	if c.registry.heard("bar") {
+		t.Errorf("expected peer not to be heard before it answers")
+	}
+	c.proven("bar", node.payloads[0][len(GROUP)+len(chal):])
+	if !c.registry.heard("bar") || len(c.Services()) > 0 {
+		t.Errorf("expected peer to be heard but not added before it enters")
+	}
+	headers := map[string]string{"group": GROUP, "node": "bar", "type": "baz"}
+	headers["signature"] = c.sealer.sign(headers)
+	event := &Event{Type: EventEnter, Name: "qux", Node: "bar", Headers: headers}
+	if err := c.enter(event); err != nil || len(c.Services()) != 1 {
+		t.Errorf("expected peer that answered to be added when it enters")
+	}
+}
+
+func TestClientOutstanding(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	c.listen("1", "foo", make(chan *http.Response, 1))
+	c.listen("2", "foo", make(chan *http.Response, 1))
+	if n := c.outstanding("foo"); n != 2 {
+		t.Errorf("expected 2 outstanding requests, got %d", n)
+	}
+	c.unlisten("1")
+	c.unlisten("2")
+	if n := c.outstanding("foo"); n != 0 {
+		t.Errorf("expected 0 outstanding requests, got %d", n)
+	}
+}
+
+func TestClientPeers(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	c.add(GROUP, &peer{name: "qux", node: "quux", service: "foo"})
+	c.add(GROUP, &peer{
+		metadata: map[string]string{"region": "corge"},
+		name:     "bar",
+		node:     "baz",
+		service:  "foo",
+		version:  "1.0.0",
+	})
+	c.add(GROUP, &peer{name: "grault", node: "garply", service: "waldo"})
+	if services := c.Services(); len(services) != 2 ||
+		services[0] != "foo" || services[1] != "waldo" {
+		t.Errorf("expected services [foo waldo], got %v", services)
+	}
+	peers := c.Peers("foo")
+	if len(peers) != 2 || peers[0].Name != "bar" || peers[1].Name != "qux" {
+		t.Errorf("expected peers of foo to be sorted by name, got %v", peers)
+		return
+	}
+	info := peers[0]
+	if info.Node != "baz" || info.Version != "1.0.0" || info.Weight != 1 ||
+		info.Metadata["region"] != "corge" || info.Seen.IsZero() {
+		t.Errorf("expected peer information to be complete, got %v", info)
+	}
+	info.Metadata["region"] = "fred"
+	if c.Peers("foo")[0].Metadata["region"] != "corge" {
+		t.Errorf("expected peer metadata to be copied")
+	}
+	if peers := c.Peers("plugh"); peers != nil {
+		t.Errorf("expected unknown service to have no peers, got %v", peers)
+	}
+}
+
 func TestClientReceiveBadHandle(t *testing.T) {
 	log, _ := logger.New(logger.Silent)
 	c := newClient(GROUP, nil, log)
 	res := &response{Handle: "1"}
-	err := c.receive(resMarshal(GROUP, res)[len(GROUP)+len(recv):])
+	err := c.receive("", resMarshal(GROUP, res)[len(GROUP)+len(recv):])
 	if err == nil {
 		t.Errorf("expected client receive to fail on bad handle")
 		return
@@ -174,7 +622,7 @@ func TestClientReceiveBadHandle(t *testing.T) {
 func TestClientReceiveBadPayload(t *testing.T) {
 	log, _ := logger.New(logger.Silent)
 	c := newClient(GROUP, nil, log)
-	err := c.receive([]byte(""))
+	err := c.receive("", []byte(""))
 	if err == nil {
 		t.Errorf("expected client receive to fail on bad payload")
 		return
@@ -182,6 +630,30 @@ func TestClientReceiveBadPayload(t *testing.T) {
 	testCodes(t, err, []int{errUnzip, errResUnmarshal, errRECV})
 }
 
+func TestClientShutdownClosed(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	c.closed = 1
+	err := c.Shutdown(context.Background())
+	if err == nil {
+		t.Errorf("expected Shutdown to fail for a closed client")
+		return
+	}
+	testCodes(t, err, []int{errClosed, errShutdown})
+}
+
+func TestClientUpdateUnknownNode(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	payload := append([]byte(GROUP+annc), zip([]byte("{}"))...)
+	err := c.dispatch("foo", payload)
+	if err == nil {
+		t.Errorf("expected dispatch to fail for an unknown node")
+		return
+	}
+	testCodes(t, err, []int{errANNC})
+}
+
 func TestClientRemove(t *testing.T) {
 	log, _ := logger.New(logger.Silent)
 	c := newClient(GROUP, nil, log)
@@ -192,7 +664,12 @@ func TestClientRemove(t *testing.T) {
 		t.Errorf("expected workers to be empty")
 		return
 	}
-	c.add(GROUP, name, "node id", service, "v0.0.1")
+	c.add(GROUP, &peer{
+		name:    name,
+		node:    "node id",
+		service: service,
+		version: "v0.0.1",
+	})
 	if workers[service] == nil || !workers[service].available() {
 		t.Errorf("expected client add to succeed")
 		return
@@ -210,10 +687,41 @@ func TestClientRemoveNonexistent(t *testing.T) {
 	c.remove("foo") // c.remove is a no op.
 }
 
+func TestClientReplyForgedNode(t *testing.T) {
+	network := NewMemoryNetwork()
+	var admitted []string
+	c, _ := New(&Config{
+		group: GROUP,
+		Admission: func(node, service string, req *http.Request) int {
+			admitted = append(admitted, node)
+			return http.StatusForbidden
+		},
+		CallerLimit: &Limit{Burst: 1, Rate: 1},
+		Handler:     new(echoHandler),
+		Service:     "foo",
+		Transport:   network.Transport(),
+	})
+	defer c.Close()
+	in, _ := http.NewRequest("GET", "sleuth://foo/bar", nil)
+	payload, _, _ := reqMarshal(GROUP, "forged", "1", in)
+	if err := c.reply("sender", payload[len(GROUP)+len(repl):]); err != nil {
+		t.Errorf("reply failed: %s", err.Error())
+		return
+	}
+	if len(admitted) != 1 || admitted[0] != "sender" {
+		t.Errorf("expected request to be admitted from sender, got %v", admitted)
+	}
+	c.limiter.Lock()
+	defer c.limiter.Unlock()
+	if _, ok := c.limiter.callers["forged"]; ok || len(c.limiter.callers) != 1 {
+		t.Errorf("expected request to be limited as coming from sender")
+	}
+}
+
 func TestClientReplyBadPayload(t *testing.T) {
 	log, _ := logger.New(logger.Silent)
 	c := newClient(GROUP, nil, log)
-	err := c.reply([]byte(""))
+	err := c.reply("foo", []byte(""))
 	if err == nil {
 		t.Errorf("expected client reply to fail on bad payload")
 		return
@@ -221,9 +729,86 @@ func TestClientReplyBadPayload(t *testing.T) {
 	testCodes(t, err, []int{errUnzip, errReqUnmarshal, errREPL})
 }
 
+func TestClientRegisterBad(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	if err := c.Register("", "", new(echoHandler)); err == nil {
+		t.Errorf("expected Register to fail without a service name")
+	} else {
+		testCodes(t, err, []int{errRegister})
+	}
+	if err := c.Register("foo", "", nil); err == nil {
+		t.Errorf("expected Register to fail without a handler")
+	} else {
+		testCodes(t, err, []int{errRegister})
+	}
+	if err := c.Register("foo", "", new(echoHandler)); err != nil {
+		t.Errorf("expected Register to succeed: %s", err.Error())
+	}
+	if err := c.Register("foo", "", new(echoHandler)); err == nil {
+		t.Errorf("expected Register to fail for a registered service")
+	} else {
+		testCodes(t, err, []int{errRegister})
+	}
+	if err := c.Unregister("bar"); err == nil {
+		t.Errorf("expected Unregister to fail for an unknown service")
+	} else {
+		testCodes(t, err, []int{errRegister})
+	}
+	c.closed = 1
+	if err := c.Unregister("foo"); err == nil {
+		t.Errorf("expected Unregister to fail for a closed client")
+	} else {
+		testCodes(t, err, []int{errClosed, errRegister})
+	}
+}
+
+func TestClientUnregisterPrimary(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	for _, service := range []string{"foo", "qux", "bar"} {
+		if err := c.Register(service, "", new(echoHandler)); err != nil {
+			t.Errorf("expected Register to succeed: %s", err.Error())
+			return
+		}
+	}
+	if err := c.Unregister("foo"); err != nil {
+		t.Errorf("expected Unregister to succeed: %s", err.Error())
+		return
+	}
+	if service, _ := c.registry.route(""); service != "bar" {
+		t.Errorf("expected unnamed service to route to bar, got %s", service)
+	}
+	c.Unregister("bar")
+	c.Unregister("qux")
+	if service, _ := c.registry.route(""); service != "" {
+		t.Errorf("expected unnamed service to route nowhere, got %s", service)
+	}
+}
+
+func TestClientRoundTripUnknownService(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	client := &http.Client{Transport: c}
+	_, err := client.Get("sleuth://foo/bar")
+	if err == nil {
+		t.Errorf("expected http client to fail on unknown service")
+		return
+	}
+	testCodes(t, err.(*url.Error).Err, []int{errUnknownService})
+	// The body of a request that fails before it is sent is closed.
+	body := new(failedBody)
+	req, _ := http.NewRequest("POST", "sleuth://foo/bar", body)
+	if _, err := c.RoundTrip(req); err == nil {
+		t.Errorf("expected RoundTrip to fail on unknown service")
+	} else if !body.closed {
+		t.Errorf("expected RoundTrip to close the body of a failed request")
+	}
+}
+
 func TestClientWaitForClosed(t *testing.T) {
 	c := newClient(GROUP, nil, nil)
-	c.closed = true
+	c.closed = 1
 	err := c.WaitFor("foo")
 	if err == nil {
 		t.Errorf("expected client wait to return an error if closed")
@@ -232,6 +817,127 @@ func TestClientWaitForClosed(t *testing.T) {
 	testCodes(t, err, []int{errClosed, errWait})
 }
 
+func TestClientWaitForConcurrent(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	sets := [][]string{{"foo"}, {"bar"}, {"foo", "bar"}, {"baz", "foo"}}
+	results := make(chan error, len(sets)*5)
+	for i := 0; i < len(sets)*5; i++ {
+		go func(services []string) {
+			results <- c.WaitForContext(ctx, services...)
+		}(sets[i%len(sets)])
+	}
+	// A waiter for a service that never appears does not hold up the others.
+	short, stop := context.WithTimeout(ctx, time.Millisecond*50)
+	defer stop()
+	missing := make(chan error, 1)
+	go func() { missing <- c.WaitForContext(short, "qux") }()
+	for _, service := range []string{"foo", "bar", "baz"} {
+		<-time.After(time.Millisecond)
+		c.add(GROUP, &peer{name: service, node: service, service: service})
+	}
+	for i := 0; i < len(sets)*5; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("expected concurrent waiters to succeed: %s", err.Error())
+		}
+	}
+	if err := <-missing; err == nil {
+		t.Errorf("expected waiter for a missing service to time out")
+	}
+}
+
+func TestClientWaitForQuorum(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	for _, name := range []string{"foo", "bar"} {
+		c.add(GROUP, &peer{name: name, node: name, service: "baz", version: "1.0.0"})
+	}
+	c.add(GROUP, &peer{name: "qux", node: "qux", service: "baz", version: "2.0.0"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	err := c.WaitForQuorum(ctx, Requirement{Count: 3, Service: "baz"},
+		Requirement{Count: 2, Service: "baz", Version: "2"})
+	if err == nil {
+		t.Errorf("expected quorum wait to fail without enough version 2 peers")
+		return
+	}
+	testCodes(t, err, []int{errDeadline, errWait})
+	want := "still waiting for [baz@2*2 (1/2)]: context deadline exceeded"
+	if err.(*Error).message != want {
+		t.Errorf("expected %q, got %q", want, err.(*Error).message)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- c.WaitForQuorum(context.Background(),
+			Requirement{Count: 2, Service: "baz", Version: "2"})
+	}()
+	c.add(GROUP, &peer{name: "quux", node: "quux", service: "baz", version: "2.1.0"})
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("expected quorum wait to succeed: %s", err.Error())
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("expected quorum wait to return when the quorum is met")
+	}
+}
+
+func TestClientWaitForContextClose(t *testing.T) {
+	c, _ := New(&Config{group: GROUP, Transport: NewMemoryNetwork().Transport()})
+	result := make(chan error, 1)
+	go func() { result <- c.WaitFor("foo") }()
+	// Give WaitFor a chance to block before the client is closed.
+	<-time.After(time.Millisecond * 10)
+	c.Close()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Errorf("expected client wait to fail when the client closes")
+			return
+		}
+		testCodes(t, err, []int{errClosed, errWait})
+	case <-time.After(time.Second * 5):
+		t.Errorf("expected client wait to return when the client closes")
+	}
+}
+
+func TestClientWaitForContextDeadline(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	c.add(GROUP, &peer{name: "foo", node: "foo", service: "foo"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	err := c.WaitForContext(ctx, "foo", "bar@1", "baz")
+	if err == nil {
+		t.Errorf("expected client wait to fail when its deadline passes")
+		return
+	}
+	testCodes(t, err, []int{errDeadline, errWait})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error to wrap context.DeadlineExceeded")
+	}
+	want := "still waiting for [bar@1 baz]: context deadline exceeded"
+	if err.(*Error).message != want {
+		t.Errorf("expected %q, got %q", want, err.(*Error).message)
+	}
+	if err := c.WaitForContext(ctx, "foo"); err != nil {
+		t.Errorf("expected available service not to need waiting: %s", err)
+	}
+}
+
+func TestClientWaitForBadVersion(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	err := c.WaitFor("foo@>=bar")
+	if err == nil {
+		t.Errorf("expected client WaitFor to fail on bad version")
+		return
+	}
+	testCodes(t, err, []int{errVersion, errWait})
+}
+
 // Test config.go
 func TestInitConfig(t *testing.T) {
 	config := initConfig(nil)
@@ -253,20 +959,285 @@ func TestError(t *testing.T) {
 	}
 }
 
-// Test request.go
+// Test hedge.go
 
-func TestRequestUnmarshalBadJSON(t *testing.T) {
-	payload := zip([]byte("{bad json}"))
-	_, _, err := reqUnmarshal(GROUP, payload)
-	if err == nil {
-		t.Errorf("expected unmarshalReq to fail on bad json")
+func TestHedging(t *testing.T) {
+	req, _ := http.NewRequest("GET", "sleuth://foo/", nil)
+	if _, hedged, _ := hedging(req); hedged {
+		t.Errorf("expected requests without a hedge header not to be hedged")
+	}
+	req.Header.Set(HedgeHeader, "p95")
+	if percent, hedged, err := hedging(req); err != nil || !hedged || percent != 95 {
+		t.Errorf("expected request to be hedged at the 95th percentile")
+	}
+	req.Header.Set(HedgeHeader, "foo")
+	if _, _, err := hedging(req); err == nil {
+		t.Errorf("expected hedging to fail on a bad percentile")
+	} else {
+		testCodes(t, err, []int{errHedge})
+	}
+	req.Method = "POST"
+	req.Header.Set(HedgeHeader, "95")
+	if _, _, err := hedging(req); err == nil {
+		t.Errorf("expected hedging to fail for a POST request")
+	} else {
+		testCodes(t, err, []int{errHedge})
+	}
+}
+
+func TestLatenciesPercentile(t *testing.T) {
+	l := newLatencies()
+	l.record("foo", time.Millisecond)
+	if _, ok := l.percentile("foo", 95); ok {
+		t.Errorf("expected too few samples to have no percentile")
+	}
+	for i := 1; i <= samples*2; i++ {
+		l.record("foo", time.Duration(i%100+1)*time.Millisecond)
+	}
+	if d, ok := l.percentile("foo", 50); !ok || d < 45*time.Millisecond ||
+		d > 55*time.Millisecond {
+		t.Errorf("expected 50th percentile to be about 50ms, got %s", d)
+	}
+	if d, _ := l.percentile("foo", 100); d != 100*time.Millisecond {
+		t.Errorf("expected 100th percentile to be 100ms, got %s", d)
+	}
+}
+
+// Test limit.go
+
+func TestLimiterAdmit(t *testing.T) {
+	if _, ok := newLimiter(nil, nil).admit("foo", "bar", time.Now()); !ok {
+		t.Errorf("expected a nil limiter to admit every request")
+	}
+	now := time.Now()
+	l := newLimiter(&Limit{Burst: 2, Rate: 1},
+		map[string]Limit{"baz": {Rate: 10}})
+	for i := 0; i < 2; i++ {
+		if _, ok := l.admit("foo", "bar", now); !ok {
+			t.Errorf("expected request %d within the burst to be admitted", i)
+		}
+	}
+	if wait, ok := l.admit("foo", "bar", now); ok || wait != time.Second {
+		t.Errorf("expected a 1s wait after the burst, got %s", wait)
+	}
+	if _, ok := l.admit("qux", "bar", now); !ok {
+		t.Errorf("expected each caller to have its own bucket")
+	}
+	if _, ok := l.admit("foo", "bar", now.Add(time.Second)); !ok {
+		t.Errorf("expected the bucket to refill")
+	}
+	if _, ok := l.admit("qux", "baz", now); !ok {
+		t.Errorf("expected the first request to a limited service to be admitted")
+	}
+	wait, ok := l.admit("quux", "baz", now)
+	if ok || wait != time.Millisecond*100 {
+		t.Errorf("expected a 100ms wait for a limited service, got %s", wait)
+	}
+	// A request rejected by the service limit does not use a caller token.
+	if _, ok := l.admit("quux", "bar", now); !ok {
+		t.Errorf("expected rejected request not to use a caller token")
+	}
+	l.forget("foo")
+	if _, ok := l.callers["foo"]; ok {
+		t.Errorf("expected bucket of a departed node to be forgotten")
+	}
+}
+
+// Test memory.go
+
+func TestMemoryStopTwice(t *testing.T) {
+	node := NewMemoryNetwork().Transport()
+	node.Start()
+	if err := node.Stop(); err != nil {
+		t.Errorf("expected memory transport to stop: %s", err.Error())
+		return
+	}
+	err := node.Stop()
+	if err == nil {
+		t.Errorf("expected memory transport stop to fail the second time")
+		return
+	}
+	testCodes(t, err, []int{errMemory})
+}
+
+func TestMemoryWhisperUnknown(t *testing.T) {
+	node := NewMemoryNetwork().Transport()
+	node.Start()
+	defer node.Stop()
+	err := node.Whisper("foo", []byte("bar"))
+	if err == nil {
+		t.Errorf("expected memory transport whisper to unknown peer to fail")
+		return
+	}
+	testCodes(t, err, []int{errMemory})
+}
+
+// Test native.go
+
+func TestNativeReadFrameBadLength(t *testing.T) {
+	_, _, err := readFrame(bytes.NewBuffer([]byte{0, 0, 0, 0}))
+	if err == nil {
+		t.Errorf("expected readFrame to fail on empty frame")
+		return
+	}
+	testCodes(t, err, []int{errNative})
+}
+
+func TestNativeWhisperUnknown(t *testing.T) {
+	node, _ := newNative(port, "")
+	err := node.Whisper("foo", []byte("bar"))
+	if err == nil {
+		t.Errorf("expected native transport whisper to unknown peer to fail")
+		return
+	}
+	testCodes(t, err, []int{errNative})
+}
+
+// Test queue.go
+
+func TestQueue(t *testing.T) {
+	if q := newQueue(0, 1); q != nil {
+		t.Errorf("expected an unlimited queue to be nil")
+	}
+	q := newQueue(1, 1)
+	defer q.close()
+	gate := make(chan struct{})
+	done := make(chan struct{}, 2)
+	job := func() {
+		<-gate
+		done <- struct{}{}
+	}
+	if !q.push(job) || !q.push(job) {
+		t.Errorf("expected queue to accept a running and a waiting job")
+	}
+	if q.push(job) {
+		t.Errorf("expected a full queue to reject a job")
+	}
+	close(gate)
+	<-done
+	<-done
+	if !q.push(func() {}) {
+		t.Errorf("expected queue to accept a job once it has room")
+	}
+}
+
+// Test registry.go
+
+func TestRegistryRoute(t *testing.T) {
+	r := newRegistry()
+	r.primary = "foo"
+	r.handlers["foo"] = &versionHandler{version: "foo"}
+	r.handlers["bar"] = &versionHandler{version: "bar"}
+	for service, want := range map[string]string{"": "foo", "bar": "bar"} {
+		res := httptest.NewRecorder()
+		name, handler := r.route(service)
+		if name != want {
+			t.Errorf("expected %q to resolve to %s, got %s", service, want, name)
+		}
+		handler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+		if res.Body.String() != want {
+			t.Errorf("expected %q to route to %s, got %s",
+				service, want, res.Body.String())
+		}
+	}
+	res := httptest.NewRecorder()
+	_, handler := r.route("baz")
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown service to be not found, got %d", res.Code)
+	}
+}
+
+// Test request.go
+
+func TestRequestUnmarshalBadJSON(t *testing.T) {
+	payload := zip([]byte("{bad json}"))
+	_, _, err := reqUnmarshal(GROUP, payload)
+	if err == nil {
+		t.Errorf("expected unmarshalReq to fail on bad json")
 		return
 	}
 	testCodes(t, err, []int{errReqUnmarshalJSON})
 }
 
+func TestRequestDeadline(t *testing.T) {
+	timeout := time.Second * 5
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	in, _ := http.NewRequest("GET", "sleuth://foo/bar", nil)
+	payload, _, err := reqMarshal(GROUP, "baz", "1", in.WithContext(ctx))
+	if err != nil {
+		t.Errorf("reqMarshal failed: %s", err.Error())
+		return
+	}
+	dest, _, err := reqUnmarshal(GROUP, payload[len(GROUP)+len(repl):])
+	if err != nil {
+		t.Errorf("reqUnmarshal failed: %s", err.Error())
+		return
+	}
+	if remaining := dest.deadline.Sub(time.Now()); remaining <= 0 ||
+		remaining > timeout {
+		t.Errorf("expected deadline to be within %s, got %s", timeout, remaining)
+	}
+}
+
+// failedBody is a request body that cannot be read.
+type failedBody struct {
+	closed bool
+}
+
+func (b *failedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *failedBody) Read(p []byte) (int, error) {
+	return 0, errors.New("failed body")
+}
+
+func TestRequestMarshalFailedBody(t *testing.T) {
+	body := new(failedBody)
+	in, _ := http.NewRequest("POST", "sleuth://foo/bar", body)
+	_, _, err := reqMarshal(GROUP, "baz", "1", in)
+	if err == nil {
+		t.Errorf("expected reqMarshal to fail on unreadable body")
+		return
+	}
+	testCodes(t, err, []int{errReqMarshal})
+	if !body.closed {
+		t.Errorf("expected reqMarshal to close unreadable body")
+	}
+}
+
+func TestRequestMarshalURL(t *testing.T) {
+	in, _ := http.NewRequest("GET", "sleuth://foo/bar?baz=qux", nil)
+	if _, _, err := reqMarshal(GROUP, "quux", "1", in); err != nil {
+		t.Errorf("reqMarshal failed: %s", err.Error())
+		return
+	}
+	if url := in.URL.String(); url != "sleuth://foo/bar?baz=qux" {
+		t.Errorf("expected reqMarshal to leave request URL intact, got %s", url)
+	}
+}
+
 // Test response.go
 
+func TestResponseUnmarshal(t *testing.T) {
+	res := &response{Code: http.StatusNotFound, Handle: "1"}
+	payload := resMarshal(GROUP, res)[len(GROUP)+len(recv):]
+	_, out, err := resUnmarshal(payload)
+	if err != nil {
+		t.Errorf("resUnmarshal failed: %s", err.Error())
+		return
+	}
+	if out.Status != "404 Not Found" {
+		t.Errorf("expected status line to be \"404 Not Found\", got %s", out.Status)
+	}
+	if out.Proto != "HTTP/1.1" || out.ProtoMajor != 1 || out.ProtoMinor != 1 {
+		t.Errorf("expected protocol to be HTTP/1.1, got %s", out.Proto)
+	}
+}
+
 func TestResponseUnmarshalBadJSON(t *testing.T) {
 	payload := zip([]byte("{bad json}"))
 	_, _, err := resUnmarshal(payload)
@@ -277,6 +1248,97 @@ func TestResponseUnmarshalBadJSON(t *testing.T) {
 	testCodes(t, err, []int{errResUnmarshalJSON})
 }
 
+// Test retry.go
+
+func TestRetryPolicyAttempts(t *testing.T) {
+	r := &RetryPolicy{Attempts: 3}
+	get, _ := http.NewRequest("GET", "sleuth://foo/", nil)
+	if n := r.attempts(get); n != 3 {
+		t.Errorf("expected GET to be attempted 3 times, got %d", n)
+	}
+	post, _ := http.NewRequest("POST", "sleuth://foo/", nil)
+	if n := r.attempts(post); n != 1 {
+		t.Errorf("expected POST to be attempted once, got %d", n)
+	}
+	r.Methods = []string{"POST"}
+	if n := r.attempts(post); n != 3 {
+		t.Errorf("expected POST to be attempted 3 times, got %d", n)
+	}
+	// A body that cannot be read again cannot be retried.
+	post.Body, post.GetBody = ioutil.NopCloser(bytes.NewBufferString("foo")), nil
+	if n := r.attempts(post); n != 1 {
+		t.Errorf("expected POST without GetBody to be attempted once, got %d", n)
+	}
+	if n := (*RetryPolicy)(nil).attempts(get); n != 1 {
+		t.Errorf("expected no policy to mean one attempt, got %d", n)
+	}
+}
+
+// Test seal.go
+
+func TestSealer(t *testing.T) {
+	if s, _ := newSealer(GROUP, ""); s != nil {
+		t.Errorf("expected no sealer without a key")
+	}
+	s, _ := newSealer(GROUP, "foo")
+	other, _ := newSealer(GROUP, "bar")
+	payload := []byte(GROUP + repl + "baz")
+	sealed, err := s.seal("qux", "quux", payload)
+	if err != nil {
+		t.Errorf("seal failed: %s", err.Error())
+		return
+	}
+	if bytes.Contains(sealed, []byte(repl+"baz")) {
+		t.Errorf("expected sealed message to be encrypted")
+	}
+	if opened, err := s.open("qux", "quux", sealed); err != nil {
+		t.Errorf("open failed: %s", err.Error())
+	} else if !bytes.Equal(opened, payload) {
+		t.Errorf("expected %q, got %q", payload, opened)
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	rejects := []struct {
+		opener   *sealer
+		from, to string
+		payload  []byte
+	}{
+		{other, "qux", "quux", sealed},
+		{s, "quux", "quux", sealed},
+		{s, "qux", "qux", sealed},
+		{s, "qux", "quux", tampered},
+		{s, "qux", "quux", payload[:len(GROUP)]},
+		{s, "qux", "quux", sealed}, // Replayed.
+	}
+	for i, reject := range rejects {
+		if _, err := reject.opener.open(reject.from, reject.to, reject.payload); err == nil {
+			t.Errorf("expected case %d to be rejected", i)
+		} else {
+			testCodes(t, err, []int{errSeal})
+		}
+	}
+}
+
+func TestSealerSequences(t *testing.T) {
+	w := new(sequences)
+	accepted := []uint64{3, 1, 2, 5000, 4000, 4999}
+	for _, sequence := range accepted {
+		if !w.accept(sequence) {
+			t.Errorf("expected sequence %d to be accepted", sequence)
+		}
+	}
+	rejected := []uint64{0, 1, 4, 3976, 4000, 5000}
+	for _, sequence := range rejected {
+		if w.accept(sequence) {
+			t.Errorf("expected sequence %d to be rejected", sequence)
+		}
+	}
+	// Bits that the window has moved past are reused.
+	if !w.accept(5000+replayWindow) || !w.accept(4000+replayWindow) {
+		t.Errorf("expected sequences within the moved window to be accepted")
+	}
+}
+
 // Test sleuth.go
 
 func TestSleuthNewBadInterface(t *testing.T) {
@@ -288,6 +1350,38 @@ func TestSleuthNewBadInterface(t *testing.T) {
 	testCodes(t, err, []int{errStart, errNew})
 }
 
+func TestSleuthNewBadBackend(t *testing.T) {
+	_, err := New(&Config{group: GROUP, Backend: "foo"})
+	if err == nil {
+		t.Errorf("expected New to fail with an unknown backend")
+		return
+	}
+	testCodes(t, err, []int{errBackend, errNew})
+}
+
+func TestSleuthNewBadBalancer(t *testing.T) {
+	_, err := New(&Config{group: GROUP, Balancers: map[string]string{"foo": "bar"}})
+	if err == nil {
+		t.Errorf("expected New to fail with an unknown balancer")
+		return
+	}
+	testCodes(t, err, []int{errBalancer, errNew})
+}
+
+func TestSleuthNewBadLimit(t *testing.T) {
+	configs := []*Config{
+		{group: GROUP, CallerLimit: &Limit{Burst: 1}},
+		{group: GROUP, ServiceLimits: map[string]Limit{"foo": {Rate: -1}}},
+	}
+	for _, config := range configs {
+		if _, err := New(config); err == nil {
+			t.Errorf("expected New to fail with a rate limit of zero or less")
+		} else {
+			testCodes(t, err, []int{errLimit, errNew})
+		}
+	}
+}
+
 func TestSleuthNewBadLogLevel(t *testing.T) {
 	c, _ := New(&Config{group: GROUP, LogLevel: "foo"})
 	if c.log.Level() != logger.Debug {
@@ -297,7 +1391,7 @@ func TestSleuthNewBadLogLevel(t *testing.T) {
 }
 
 func TestSleuthNewBadPort(t *testing.T) {
-	_, err := New(&Config{group: GROUP, Port: 1})
+	_, err := New(&Config{group: GROUP, Port: 70000})
 	if err == nil {
 		t.Errorf("expected New to fail on start with bad port")
 		return
@@ -314,6 +1408,27 @@ func TestSleuthNewBadService(t *testing.T) {
 	testCodes(t, err, []int{errService})
 }
 
+func TestSleuthNewBadServices(t *testing.T) {
+	services := []map[string]Service{
+		{"foo": {}},
+		{"": {Handler: new(echoHandler)}},
+		{"bar": {Handler: new(echoHandler)}},
+	}
+	for _, services := range services {
+		_, err := New(&Config{
+			group:    GROUP,
+			Handler:  new(echoHandler),
+			Service:  "bar",
+			Services: services,
+		})
+		if err == nil {
+			t.Errorf("expected New to fail with services %v", services)
+			continue
+		}
+		testCodes(t, err, []int{errService})
+	}
+}
+
 // Test workers.go
 
 func TestWorkersAddDuplicate(t *testing.T) {
@@ -354,6 +1469,23 @@ func TestWorkersNextNonexistent(t *testing.T) {
 	}
 }
 
+func TestWorkersPickVersion(t *testing.T) {
+	w := newWorkers()
+	w.add(&peer{name: "foo", node: "bar", version: "1.0.0"})
+	w.add(&peer{name: "baz", node: "qux", version: "2.1.0"})
+	want, _ := parseConstraint(">=2.1 <3")
+	eligible := func(p *peer) bool { return want.match(p.version) }
+	for i := 0; i < 3; i++ {
+		if p := w.pick(RoundRobin, "", eligible, nil); p == nil || p.name != "baz" {
+			t.Error("expected pick to return the matching version")
+		}
+	}
+	want, _ = parseConstraint("3")
+	if p := w.pick(RoundRobin, "", eligible, nil); p != nil {
+		t.Error("expected pick to return nil without a matching version")
+	}
+}
+
 func TestWorkersRemove(t *testing.T) {
 	w := newWorkers()
 	w.add(&peer{name: "foo", node: "bar", service: "baz"})
@@ -369,15 +1501,55 @@ func TestWorkersRemoveNonexistent(t *testing.T) {
 	}
 }
 
+// Test stream.go
+
+func TestStreamBackpressure(t *testing.T) {
+	s := newStreams()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	out := s.writer(ctx, &link{group: GROUP, node: new(goodWhisperer)})
+	for i := 0; i < window; i++ {
+		if err := out.write([]byte("foo"), false); err != nil {
+			t.Errorf("expected write within window to succeed: %s", err.Error())
+			return
+		}
+	}
+	go out.grant(&chunk{Credit: 1})
+	if err := out.write([]byte("bar"), false); err != nil {
+		t.Errorf("expected write after credit to succeed: %s", err.Error())
+		return
+	}
+	err := out.write([]byte("baz"), false)
+	if err == nil {
+		t.Errorf("expected write beyond window to block until deadline")
+		return
+	}
+	testCodes(t, err, []int{errStream})
+}
+
+func TestStreamReadReset(t *testing.T) {
+	s := newStreams()
+	in := s.reader(context.Background(), &link{
+		group: GROUP, node: new(goodWhisperer), peer: "foo"})
+	in.push(&chunk{Data: []byte("bar")})
+	in.push(&chunk{Reset: true})
+	_, err := ioutil.ReadAll(in)
+	if err == nil {
+		t.Errorf("expected read of reset stream to fail")
+		return
+	}
+	testCodes(t, err, []int{errStream})
+}
+
 // Test writer.go
 
 func TestWriterWrite(t *testing.T) {
 	data := []byte("foo bar baz")
-	w := newWriter(new(goodWhisperer), &destination{
+	w := newWriter(context.Background(), new(goodWhisperer), &destination{
 		group:  GROUP,
 		node:   "qux",
 		handle: "2",
-	})
+	}, newStreams())
 	if n, err := w.Write(data); err != nil {
 		t.Errorf("expected write to succeed: %s", err.Error())
 	} else if n <= 0 {
@@ -385,14 +1557,15 @@ func TestWriterWrite(t *testing.T) {
 	}
 }
 
-func TestWriterWriteBadWhisperer(t *testing.T) {
+func TestWriterCloseBadWhisperer(t *testing.T) {
 	data := []byte("foo bar baz")
-	w := newWriter(new(badWhisperer), &destination{
+	w := newWriter(context.Background(), new(badWhisperer), &destination{
 		group:  GROUP,
 		node:   "qux",
 		handle: "3",
-	})
-	_, err := w.Write(data)
+	}, newStreams())
+	w.Write(data)
+	err := w.close()
 	if err == nil {
 		t.Errorf("expected writer to fail using bad whisperer")
 		return
@@ -400,6 +1573,253 @@ func TestWriterWriteBadWhisperer(t *testing.T) {
 	testCodes(t, err, []int{errResWhisper})
 }
 
+func TestWriterWriteStreamBadWhisperer(t *testing.T) {
+	data := make([]byte, chunkSize)
+	w := newWriter(context.Background(), new(badWhisperer), &destination{
+		group:  GROUP,
+		node:   "qux",
+		handle: "4",
+	}, newStreams())
+	_, err := w.Write(data)
+	if err == nil {
+		t.Errorf("expected streaming writer to fail using bad whisperer")
+		return
+	}
+	testCodes(t, err, []int{errResWhisper})
+}
+
+func TestWriterFlush(t *testing.T) {
+	r := new(recordWhisperer)
+	w := newWriter(context.Background(), r, &destination{
+		group:  GROUP,
+		node:   "qux",
+		handle: "8",
+	}, newStreams())
+	w.Write([]byte("foo"))
+	var flusher http.Flusher = w
+	flusher.Flush()
+	if len(r.payloads) != 2 {
+		t.Errorf("expected a head and a chunk after flush, got %d", len(r.payloads))
+		return
+	}
+	_, res, err := resUnmarshal(r.payloads[0][len(GROUP)+len(recv):])
+	if err != nil || res.ContentLength != -1 {
+		t.Errorf("expected a flushed response to be streamed")
+	}
+	c, err := chunkUnmarshal(r.payloads[1][len(GROUP)+len(data):])
+	if err != nil {
+		t.Errorf("chunkUnmarshal failed: %s", err.Error())
+	} else if string(c.Data) != "foo" || c.End {
+		t.Errorf("expected flushed chunk to hold foo, got %s", string(c.Data))
+	}
+}
+
+func TestWriterHeaderAfterWriteHeader(t *testing.T) {
+	r := new(recordWhisperer)
+	w := newWriter(context.Background(), r, &destination{
+		group:  GROUP,
+		node:   "qux",
+		handle: "5",
+	}, newStreams())
+	w.Header().Set("X-Foo", "foo")
+	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(http.StatusTeapot)
+	w.Header().Set("X-Bar", "bar")
+	w.Write([]byte("baz"))
+	w.close()
+	res := r.response(t)
+	if res == nil {
+		return
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("expected first status code to win, got %d", res.StatusCode)
+	}
+	if res.Header.Get("X-Foo") != "foo" || res.Header.Get("X-Bar") != "" {
+		t.Errorf("expected headers to be fixed by WriteHeader, got %v", res.Header)
+	}
+}
+
+func TestWriterMultipleWrites(t *testing.T) {
+	r := new(recordWhisperer)
+	w := newWriter(context.Background(), r, &destination{
+		group:  GROUP,
+		node:   "qux",
+		handle: "6",
+	}, newStreams())
+	for _, piece := range []string{"foo ", "bar ", "baz"} {
+		w.Write([]byte(piece))
+	}
+	if len(r.payloads) != 0 {
+		t.Errorf("expected writer to buffer until it is closed")
+		return
+	}
+	w.close()
+	res := r.response(t)
+	if res == nil {
+		return
+	}
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "foo bar baz" {
+		t.Errorf("expected all writes in one response, got %s", string(body))
+	}
+}
+
+func TestWriterNoWrite(t *testing.T) {
+	r := new(recordWhisperer)
+	w := newWriter(context.Background(), r, &destination{
+		group:  GROUP,
+		node:   "qux",
+		handle: "7",
+	}, newStreams())
+	w.WriteHeader(http.StatusNoContent)
+	if _, err := w.Write([]byte("foo")); err != http.ErrBodyNotAllowed {
+		t.Errorf("expected write to fail for %d", http.StatusNoContent)
+	}
+	w.close()
+	if res := r.response(t); res != nil && res.StatusCode != http.StatusNoContent {
+		t.Errorf("expected %d, got %d", http.StatusNoContent, res.StatusCode)
+	}
+}
+
+// Test subscription.go
+
+// expectChange compares the next change a subscription delivers with a wanted
+// change type and peer name.
+func expectChange(t *testing.T, s *Subscription, want ChangeType, name string) {
+	select {
+	case change := <-s.Changes():
+		if change.Type != want || change.Peer.Name != name {
+			t.Errorf("expected %s for %s, got %s for %s",
+				want, name, change.Type, change.Peer.Name)
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("expected %s for %s, got nothing", want, name)
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	all := c.Subscribe()
+	filtered := c.Subscribe("bar")
+	c.add(GROUP, &peer{name: "foo", node: "foo", service: "foo"})
+	c.add(GROUP, &peer{name: "baz", node: "baz", service: "bar"})
+	c.add(GROUP, &peer{name: "qux", node: "qux", service: "bar"})
+	c.remove("baz")
+	c.remove("qux")
+	expectChange(t, all, PeerJoined, "foo")
+	expectChange(t, all, ServiceAvailable, "foo")
+	expectChange(t, all, PeerJoined, "baz")
+	expectChange(t, all, ServiceAvailable, "baz")
+	expectChange(t, filtered, PeerJoined, "baz")
+	expectChange(t, filtered, ServiceAvailable, "baz")
+	expectChange(t, filtered, PeerJoined, "qux")
+	expectChange(t, filtered, PeerLeft, "baz")
+	expectChange(t, filtered, PeerLeft, "qux")
+	expectChange(t, filtered, ServiceUnavailable, "qux")
+	filtered.Close()
+	if _, ok := <-filtered.Changes(); ok {
+		t.Errorf("expected closed subscription to close its channel")
+	}
+	c.subscribers.close()
+	for range all.Changes() {
+	}
+	if _, ok := <-c.Subscribe().Changes(); ok {
+		t.Errorf("expected subscription to a closed client to be closed")
+	}
+}
+
+func TestSubscriptionDropped(t *testing.T) {
+	log, _ := logger.New(logger.Silent)
+	c := newClient(GROUP, nil, log)
+	s := c.Subscribe()
+	defer s.Close()
+	for i := 0; i < buffer+1; i++ {
+		c.add(GROUP, &peer{name: "foo", node: "foo", service: "foo"})
+		c.remove("foo")
+	}
+	if dropped := s.Dropped(); dropped != (buffer+1)*4-buffer {
+		t.Errorf("expected %d dropped changes, got %d", (buffer+1)*4-buffer, dropped)
+	}
+}
+
+// Test version.go
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		match      bool
+	}{
+		{"", "unknown", true},
+		{">=2.1 <3", "2.1.0", true},
+		{">=2.1 <3", "v2.9.4", true},
+		{">=2.1 <3", "3.0.0", false},
+		{">=2.1 <3", "unknown", false},
+		{">= 2.1", "2.0.9", false},
+		{"2.1", "2.1.7", true},
+		{"2.1", "2.2.0", false},
+		{"=1.2.3", "1.2.3+build", true},
+		{"!=1.2.3", "1.2.3", false},
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{"^1.2.3", "1.9.0", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.4", false},
+		{"<1.0.0", "1.0.0-beta", true},
+		{"1 || 3", "3.1.0", true},
+		{"1 || 3", "2.0.0", false},
+		{"*", "0.0.1", true},
+	}
+	for _, test := range tests {
+		want, err := parseConstraint(test.constraint)
+		if err != nil {
+			t.Errorf("parseConstraint(%q) failed: %s", test.constraint, err.Error())
+			continue
+		}
+		if match := want.match(test.version); match != test.match {
+			t.Errorf("expected %q matching %q to be %t", test.constraint,
+				test.version, test.match)
+		}
+	}
+}
+
+func TestVersionConstraintBad(t *testing.T) {
+	for _, constraint := range []string{">=foo", "1.2.3.4", "=>1", "<"} {
+		_, err := parseConstraint(constraint)
+		if err == nil {
+			t.Errorf("expected parseConstraint(%q) to fail", constraint)
+			continue
+		}
+		testCodes(t, err, []int{errVersion})
+	}
+}
+
+// Test work.go
+
+func TestWork(t *testing.T) {
+	w := newWork()
+	select {
+	case <-w.wait():
+	default:
+		t.Errorf("expected work to be idle")
+	}
+	w.add()
+	w.add()
+	w.done()
+	select {
+	case <-w.wait():
+		t.Errorf("expected work to be outstanding")
+	default:
+	}
+	idle := w.wait()
+	w.done()
+	select {
+	case <-idle:
+	default:
+		t.Errorf("expected work to be idle after it is done")
+	}
+}
+
 // Test zip.go
 
 func TestZipUnzipBadInput(t *testing.T) {
@@ -454,9 +1874,10 @@ func TestIntegratedCycle(t *testing.T) {
 	client.WaitFor(addr, addr)
 	// Set timeout to 10 seconds to accommodate slow test spin-up.
 	client.Timeout = time.Second * 10
-	required := make(map[string]struct{})
-	required[addr] = struct{}{}
-	if client.block(required, []string{addr}) {
+	required := make(map[string]*requirement)
+	required[addr] = &requirement{service: addr}
+	if blocked, _ := client.block(context.Background(), required,
+		[]string{addr}); blocked {
 		t.Errorf("call to block should have returned immediately")
 	}
 	body := "foo bar baz"
@@ -483,3 +1904,837 @@ func TestIntegratedCycle(t *testing.T) {
 		return
 	}
 }
+
+func TestIntegratedMemoryCycle(t *testing.T) {
+	addr := "sleuth-test-server-two"
+	network := NewMemoryNetwork()
+	client, err := New(&Config{group: GROUP, Transport: network.Transport()})
+	if err != nil {
+		t.Errorf("client instantiation failed: %s", err.Error())
+		return
+	}
+	defer client.Close()
+	server, err := New(&Config{
+		group:     GROUP,
+		Handler:   new(echoHandler),
+		Service:   addr,
+		Transport: network.Transport(),
+	})
+	if err != nil {
+		t.Errorf("server instantiation failed: %s", err.Error())
+		return
+	}
+	defer server.Close()
+	client.WaitFor(addr)
+	body := "foo bar baz"
+	buffer := bytes.NewBuffer([]byte(body))
+	request, _ := http.NewRequest("POST", scheme+"://"+addr+"/", buffer)
+	response, err := client.Do(request)
+	if err != nil {
+		t.Errorf("client.Do failed: %s", err.Error())
+		return
+	}
+	output, _ := ioutil.ReadAll(response.Body)
+	if string(output) != body {
+		t.Errorf("client.Do expected %s to equal %s", string(output), body)
+	}
+	if err := server.Close(); err != nil {
+		t.Errorf("server close failed: %s", err.Error())
+	}
+	for client.has(map[string]*requirement{addr: {service: addr}}) {
+		<-time.After(time.Millisecond)
+	}
+}
+
+func TestIntegratedNativeCycle(t *testing.T) {
+	addr := "sleuth-test-server-three"
+	client, err := New(&Config{group: GROUP, Backend: "native"})
+	if err != nil {
+		t.Errorf("client instantiation failed: %s", err.Error())
+		return
+	}
+	defer client.Close()
+	server, err := New(&Config{
+		group:   GROUP,
+		Backend: "native",
+		Handler: new(echoHandler),
+		Service: addr,
+	})
+	if err != nil {
+		t.Errorf("server instantiation failed: %s", err.Error())
+		return
+	}
+	client.WaitFor(addr)
+	client.Timeout = time.Second * 10
+	body := "foo bar baz"
+	buffer := bytes.NewBuffer([]byte(body))
+	request, _ := http.NewRequest("POST", scheme+"://"+addr+"/", buffer)
+	response, err := client.Do(request)
+	if err != nil {
+		t.Errorf("client.Do failed: %s", err.Error())
+		server.Close()
+		return
+	}
+	output, _ := ioutil.ReadAll(response.Body)
+	if string(output) != body {
+		t.Errorf("client.Do expected %s to equal %s", string(output), body)
+	}
+	if err := server.Close(); err != nil {
+		t.Errorf("server close failed: %s", err.Error())
+	}
+	for client.has(map[string]*requirement{addr: {service: addr}}) {
+		<-time.After(time.Millisecond)
+	}
+}
+
+// streamHandler echoes the request body and then appends a large response.
+type streamHandler struct{}
+
+// ServeHTTP allows streamHandler to conform to the http.Handler interface.
+func (*streamHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	io.Copy(res, req.Body)
+	res.Write(bytes.Repeat([]byte("x"), chunkSize*window*2))
+}
+
+func TestIntegratedMemoryPeers(t *testing.T) {
+	addr := "sleuth-test-server-nine"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	server, _ := New(&Config{
+		group:     GROUP,
+		Handler:   new(echoHandler),
+		Metadata:  map[string]string{"region": "foo"},
+		Service:   addr,
+		Transport: network.Transport(),
+		Version:   "1.2.3",
+		Weight:    3,
+	})
+	defer server.Close()
+	client.WaitFor(addr)
+	peers := client.Peers(addr)
+	if len(peers) != 1 {
+		t.Errorf("expected 1 peer, got %d", len(peers))
+		return
+	}
+	info := peers[0]
+	if info.Node != server.node.UUID() || info.Name != server.node.Name() ||
+		info.Version != "1.2.3" || info.Weight != 3 ||
+		info.Metadata["region"] != "foo" {
+		t.Errorf("expected advertised peer information, got %v", info)
+	}
+}
+
+func TestIntegratedMemorySubscribe(t *testing.T) {
+	addr := "sleuth-test-server-ten"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	subscription := client.Subscribe(addr)
+	defer subscription.Close()
+	server, _ := New(&Config{
+		group:     GROUP,
+		Handler:   new(echoHandler),
+		Service:   addr,
+		Transport: network.Transport(),
+	})
+	name := server.node.Name()
+	expectChange(t, subscription, PeerJoined, name)
+	expectChange(t, subscription, ServiceAvailable, name)
+	server.Close()
+	expectChange(t, subscription, PeerLeft, name)
+	expectChange(t, subscription, ServiceUnavailable, name)
+}
+
+func TestIntegratedMemoryStream(t *testing.T) {
+	addr := "sleuth-test-server-four"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	server, _ := New(&Config{
+		group:     GROUP,
+		Handler:   new(streamHandler),
+		Service:   addr,
+		Transport: network.Transport(),
+	})
+	defer server.Close()
+	client.WaitFor(addr)
+	client.Timeout = time.Second * 10
+	upload := bytes.Repeat([]byte("y"), chunkSize*3+1)
+	request, _ := http.NewRequest("POST", scheme+"://"+addr+"/",
+		bytes.NewBuffer(upload))
+	response, err := client.Do(request)
+	if err != nil {
+		t.Errorf("client.Do failed: %s", err.Error())
+		return
+	}
+	defer response.Body.Close()
+	if response.ContentLength != -1 {
+		t.Errorf("expected a streamed response, got %d", response.ContentLength)
+	}
+	output, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Errorf("reading streamed response failed: %s", err.Error())
+		return
+	}
+	want := len(upload) + chunkSize*window*2
+	if len(output) != want || !bytes.Equal(output[:len(upload)], upload) {
+		t.Errorf("expected %d bytes echoed and appended, got %d", want, len(output))
+	}
+}
+
+// eventHandler flushes one server-sent event and waits to be canceled.
+type eventHandler struct {
+	stopped chan struct{}
+}
+
+// ServeHTTP allows eventHandler to conform to the http.Handler interface.
+func (h *eventHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Write([]byte("data: foo\n\n"))
+	res.(http.Flusher).Flush()
+	<-req.Context().Done()
+	close(h.stopped)
+}
+
+func TestIntegratedMemoryEvents(t *testing.T) {
+	addr := "sleuth-test-server-five"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	handler := &eventHandler{stopped: make(chan struct{})}
+	server, _ := New(&Config{
+		group:     GROUP,
+		Handler:   handler,
+		Service:   addr,
+		Transport: network.Transport(),
+	})
+	defer server.Close()
+	client.WaitFor(addr)
+	client.Timeout = time.Second * 10
+	ctx, cancel := context.WithCancel(context.Background())
+	request, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		t.Errorf("client.Do failed: %s", err.Error())
+		return
+	}
+	defer response.Body.Close()
+	event := make([]byte, 64)
+	n, err := response.Body.Read(event)
+	if err != nil || string(event[:n]) != "data: foo\n\n" {
+		t.Errorf("expected flushed event before handler returned, got %q", event[:n])
+	}
+	cancel()
+	select {
+	case <-handler.stopped:
+	case <-time.After(time.Second * 5):
+		t.Errorf("expected canceling the request to cancel the handler")
+	}
+}
+
+// versionHandler responds with the version of the service it is serving.
+type versionHandler struct {
+	version string
+}
+
+// ServeHTTP allows versionHandler to conform to the http.Handler interface.
+func (h *versionHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	res.Write([]byte(h.version))
+}
+
+func TestIntegratedMemoryVersion(t *testing.T) {
+	addr := "sleuth-test-server-six"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	for _, version := range []string{"1.4.0", "2.1.0"} {
+		server, _ := New(&Config{
+			group:     GROUP,
+			Handler:   &versionHandler{version: version},
+			Service:   addr,
+			Transport: network.Transport(),
+			Version:   version,
+		})
+		defer server.Close()
+	}
+	client.WaitFor(addr+"@1", addr+"@>=2.1 <3")
+	client.Timeout = time.Second * 10
+	for i := 0; i < 4; i++ {
+		request, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+		request.Header.Set(VersionHeader, ">=2.1 <3")
+		response, err := client.Do(request)
+		if err != nil {
+			t.Errorf("client.Do failed: %s", err.Error())
+			return
+		}
+		if output, _ := ioutil.ReadAll(response.Body); string(output) != "2.1.0" {
+			t.Errorf("expected only version 2.1.0 to respond, got %s", output)
+		}
+	}
+	request, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+	request.Header.Set(VersionHeader, "3")
+	if _, err := client.Do(request); err == nil {
+		t.Errorf("expected client.Do to fail without a matching version")
+	} else {
+		testCodes(t, err, []int{errUnknownService})
+	}
+}
+
+// hangHandler never responds before its request is canceled.
+type hangHandler struct{}
+
+// ServeHTTP allows hangHandler to conform to the http.Handler interface.
+func (*hangHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	<-req.Context().Done()
+}
+
+func TestIntegratedMemoryRetry(t *testing.T) {
+	addr := "sleuth-test-server-seven"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	handlers := []http.Handler{new(hangHandler), new(echoHandler)}
+	for i, handler := range handlers {
+		version := strconv.Itoa(i + 1)
+		server, _ := New(&Config{
+			group:     GROUP,
+			Handler:   handler,
+			Service:   addr,
+			Transport: network.Transport(),
+			Version:   version,
+		})
+		defer server.Close()
+		client.WaitFor(addr + "@" + version)
+	}
+	client.Timeout = time.Millisecond * 200
+	client.Retry = &RetryPolicy{Attempts: 2}
+	for i := 0; i < 4; i++ {
+		body := "foo bar baz"
+		request, _ := http.NewRequest("PUT", scheme+"://"+addr+"/",
+			bytes.NewBufferString(body))
+		response, err := client.Do(request)
+		if err != nil {
+			t.Errorf("expected client.Do to fail over: %s", err.Error())
+			return
+		}
+		if output, _ := ioutil.ReadAll(response.Body); string(output) != body {
+			t.Errorf("expected %s to equal %s", string(output), body)
+		}
+	}
+}
+
+func TestIntegratedMemoryHedge(t *testing.T) {
+	addr := "sleuth-test-server-eight"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	handlers := []http.Handler{new(hangHandler), new(echoHandler)}
+	for i, handler := range handlers {
+		version := strconv.Itoa(i + 1)
+		server, _ := New(&Config{
+			group:     GROUP,
+			Handler:   handler,
+			Service:   addr,
+			Transport: network.Transport(),
+			Version:   version,
+		})
+		defer server.Close()
+		client.WaitFor(addr + "@" + version)
+	}
+	for i := 0; i < minSamples; i++ {
+		client.latencies.record(addr, time.Millisecond*10)
+	}
+	client.Timeout = time.Second * 10
+	for i := 0; i < 4; i++ {
+		request, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+		request.Header.Set(HedgeHeader, "p90")
+		started := time.Now()
+		if _, err := client.Do(request); err != nil {
+			t.Errorf("expected hedged client.Do to succeed: %s", err.Error())
+			return
+		}
+		if elapsed := time.Since(started); elapsed > time.Second*5 {
+			t.Errorf("expected hedged request to avoid the hanging peer")
+		}
+	}
+}
+
+func TestIntegratedMemoryServices(t *testing.T) {
+	addrs := []string{"sleuth-test-server-eleven", "sleuth-test-server-twelve"}
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	server, err := New(&Config{
+		group: GROUP,
+		Services: map[string]Service{
+			addrs[0]: {Handler: &versionHandler{version: "1.0.0"}, Version: "1.0.0"},
+			addrs[1]: {Handler: &versionHandler{version: "2.0.0"}, Version: "2.0.0"},
+		},
+		Transport: network.Transport(),
+	})
+	if err != nil {
+		t.Errorf("server instantiation failed: %s", err.Error())
+		return
+	}
+	defer server.Close()
+	client.WaitFor(addrs[0]+"@1", addrs[1]+"@2")
+	for i, addr := range addrs {
+		request, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+		response, err := client.Do(request)
+		if err != nil {
+			t.Errorf("client.Do failed: %s", err.Error())
+			return
+		}
+		want := strconv.Itoa(i+1) + ".0.0"
+		if output, _ := ioutil.ReadAll(response.Body); string(output) != want {
+			t.Errorf("expected %s to answer %s, got %s", addr, want, string(output))
+		}
+	}
+	if err := server.Close(); err != nil {
+		t.Errorf("server close failed: %s", err.Error())
+	}
+	for len(client.Services()) > 0 {
+		<-time.After(time.Millisecond)
+	}
+}
+
+func TestIntegratedMemoryRegister(t *testing.T) {
+	addr := "sleuth-test-server-thirteen"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	server, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer server.Close()
+	if err := server.Register(addr, "1.0.0", new(echoHandler)); err != nil {
+		t.Errorf("server.Register failed: %s", err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := client.WaitForContext(ctx, addr+"@1"); err != nil {
+		t.Errorf("expected client to find registered service: %s", err.Error())
+		return
+	}
+	body := "foo bar baz"
+	request, _ := http.NewRequest("POST", scheme+"://"+addr+"/",
+		bytes.NewBufferString(body))
+	response, err := client.Do(request)
+	if err != nil {
+		t.Errorf("client.Do failed: %s", err.Error())
+		return
+	}
+	if output, _ := ioutil.ReadAll(response.Body); string(output) != body {
+		t.Errorf("client.Do expected %s to equal %s", string(output), body)
+	}
+	// A peer that enters after the service is registered is also told about it.
+	late, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer late.Close()
+	if err := late.WaitForContext(ctx, addr); err != nil {
+		t.Errorf("expected late peer to find registered service: %s", err.Error())
+		return
+	}
+	subscription := client.Subscribe(addr)
+	defer subscription.Close()
+	if err := server.Unregister(addr); err != nil {
+		t.Errorf("server.Unregister failed: %s", err.Error())
+		return
+	}
+	expectChange(t, subscription, PeerLeft, server.node.Name())
+	expectChange(t, subscription, ServiceUnavailable, server.node.Name())
+}
+
+func TestIntegratedMemoryReregister(t *testing.T) {
+	addr := "sleuth-test-server-twenty-one"
+	network := NewMemoryNetwork()
+	server, _ := New(&Config{
+		group:     GROUP,
+		Handler:   new(echoHandler),
+		Service:   addr,
+		Transport: network.Transport(),
+		Version:   "1.0.0",
+	})
+	defer server.Close()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	client.WaitFor(addr + "@1")
+	server.Unregister(addr)
+	if err := server.Register(addr, "2.0.0", new(echoHandler)); err != nil {
+		t.Errorf("server.Register failed: %s", err.Error())
+		return
+	}
+	// A peer that enters now finds the service in the headers of the server
+	// at its old version, and it is told of the new version afterwards.
+	late, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer late.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	for _, c := range []*Client{client, late} {
+		if err := c.WaitForContext(ctx, addr+"@2"); err != nil {
+			t.Errorf("expected peer to find new version: %s", err.Error())
+			return
+		}
+		peers, _ := c.services.get(addr)
+		for _, p := range peers.all() {
+			if p.version != "2.0.0" {
+				t.Errorf("expected old version to be replaced, got %s", p.version)
+			}
+		}
+	}
+}
+
+// gateHandler holds requests until its gate is opened.
+type gateHandler struct {
+	gate    chan struct{}
+	started chan struct{}
+}
+
+// ServeHTTP allows gateHandler to conform to the http.Handler interface.
+func (h *gateHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	h.started <- struct{}{}
+	<-h.gate
+	res.Write([]byte("done"))
+}
+
+func TestIntegratedMemoryShutdown(t *testing.T) {
+	addr := "sleuth-test-server-fourteen"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	handler := &gateHandler{
+		gate:    make(chan struct{}),
+		started: make(chan struct{}, 1),
+	}
+	server, _ := New(&Config{
+		group:     GROUP,
+		Handler:   handler,
+		Service:   addr,
+		Transport: network.Transport(),
+	})
+	client.WaitFor(addr)
+	client.Timeout = time.Second * 10
+	subscription := client.Subscribe(addr)
+	defer subscription.Close()
+	result := make(chan error, 1)
+	go func() {
+		request, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+		response, err := client.Do(request)
+		if err == nil {
+			if output, _ := ioutil.ReadAll(response.Body); string(output) != "done" {
+				err = errors.New("unexpected response: " + string(output))
+			}
+		}
+		result <- err
+	}()
+	<-handler.started
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	// Peers stop routing requests to a draining server before it finishes.
+	expectChange(t, subscription, PeerLeft, server.node.Name())
+	select {
+	case err := <-shutdown:
+		t.Errorf("expected Shutdown to wait for outstanding requests: %v", err)
+	default:
+	}
+	close(handler.gate)
+	if err := <-result; err != nil {
+		t.Errorf("expected drained request to succeed: %s", err.Error())
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("expected Shutdown to succeed: %s", err.Error())
+	}
+}
+
+func TestIntegratedMemoryShutdownDeadline(t *testing.T) {
+	addr := "sleuth-test-server-fifteen"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	server, _ := New(&Config{
+		group:     GROUP,
+		Handler:   new(hangHandler),
+		Service:   addr,
+		Transport: network.Transport(),
+	})
+	client.WaitFor(addr)
+	client.Timeout = time.Second * 10
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		request, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+		client.Do(request.WithContext(ctx))
+	}()
+	defer cancel()
+	for server.work.outstanding() == 0 {
+		<-time.After(time.Millisecond)
+	}
+	deadline, stop := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer stop()
+	err := server.Shutdown(deadline)
+	if err == nil {
+		t.Errorf("expected Shutdown to fail with outstanding requests")
+		return
+	}
+	testCodes(t, err, []int{errDeadline, errShutdown})
+	if atomic.LoadInt32(&server.closed) == 0 {
+		t.Errorf("expected Shutdown to close the server anyway")
+	}
+}
+
+func TestIntegratedMemoryOverload(t *testing.T) {
+	addr := "sleuth-test-server-sixteen"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	handler := &gateHandler{
+		gate:    make(chan struct{}),
+		started: make(chan struct{}, 1),
+	}
+	server, _ := New(&Config{
+		group:       GROUP,
+		Concurrency: 1,
+		Handler:     handler,
+		Service:     addr,
+		Transport:   network.Transport(),
+	})
+	defer server.Close()
+	client.WaitFor(addr)
+	client.Timeout = time.Second * 10
+	result := make(chan error, 1)
+	go func() {
+		request, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+		_, err := client.Do(request)
+		result <- err
+	}()
+	<-handler.started
+	request, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+	response, err := client.Do(request)
+	if err != nil {
+		t.Errorf("client.Do failed: %s", err.Error())
+	} else if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected %d, got %d",
+			http.StatusServiceUnavailable, response.StatusCode)
+	}
+	close(handler.gate)
+	if err := <-result; err != nil {
+		t.Errorf("expected first request to succeed: %s", err.Error())
+	}
+}
+
+func TestIntegratedMemoryAdmission(t *testing.T) {
+	addr := "sleuth-test-server-seventeen"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	server, _ := New(&Config{
+		group: GROUP,
+		Admission: func(node, service string, req *http.Request) int {
+			if node != client.node.UUID() || service != addr {
+				return http.StatusBadRequest
+			}
+			if req.URL.Path == "/forbidden" {
+				return http.StatusForbidden
+			}
+			return 0
+		},
+		CallerLimit: &Limit{Burst: 2, Rate: 0.5},
+		Handler:     new(echoHandler),
+		Service:     addr,
+		Transport:   network.Transport(),
+	})
+	defer server.Close()
+	client.WaitFor(addr)
+	paths := []string{"/forbidden", "/", "/"}
+	codes := []int{http.StatusForbidden, http.StatusOK, http.StatusTooManyRequests}
+	for i, path := range paths {
+		request, _ := http.NewRequest("GET", scheme+"://"+addr+path, nil)
+		response, err := client.Do(request)
+		if err != nil {
+			t.Errorf("client.Do failed: %s", err.Error())
+			return
+		}
+		if response.StatusCode != codes[i] {
+			t.Errorf("expected %d for request %d, got %d",
+				codes[i], i, response.StatusCode)
+		}
+	}
+	request, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+	if response, err := client.Do(request); err != nil {
+		t.Errorf("client.Do failed: %s", err.Error())
+	} else if retry := response.Header.Get("Retry-After"); retry != "2" {
+		t.Errorf("expected Retry-After of 2, got %q", retry)
+	}
+}
+
+func TestIntegratedMemoryKey(t *testing.T) {
+	addr := "sleuth-test-server-eighteen"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{
+		group:     GROUP,
+		Key:       "foo",
+		Transport: network.Transport(),
+	})
+	defer client.Close()
+	intruder, _ := New(&Config{
+		group:     GROUP,
+		Key:       "bar",
+		Transport: network.Transport(),
+	})
+	defer intruder.Close()
+	server, _ := New(&Config{
+		group:     GROUP,
+		Handler:   new(echoHandler),
+		Key:       "foo",
+		Service:   addr,
+		Transport: network.Transport(),
+	})
+	defer server.Close()
+	client.WaitFor(addr)
+	// Peers without the group key are not discovered.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := intruder.WaitForContext(ctx, addr); err == nil {
+		t.Errorf("expected peer without the group key not to find the server")
+	}
+	body := "foo bar baz"
+	request, _ := http.NewRequest("POST", scheme+"://"+addr+"/",
+		bytes.NewBufferString(body))
+	response, err := client.Do(request)
+	if err != nil {
+		t.Errorf("client.Do failed: %s", err.Error())
+		return
+	}
+	if output, _ := ioutil.ReadAll(response.Body); string(output) != body {
+		t.Errorf("client.Do expected %s to equal %s", string(output), body)
+	}
+	// Messages from members cannot be replayed, and messages from nodes that
+	// are not members are not heard.
+	in, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+	payload, _, _ := reqMarshal(GROUP, client.node.UUID(), "ff", in)
+	sealed, _ := client.sealer.seal(client.node.UUID(), server.node.UUID(), payload)
+	if err := server.dispatch(client.node.UUID(), sealed); err != nil {
+		t.Errorf("dispatch failed: %s", err.Error())
+	}
+	if err := server.dispatch(client.node.UUID(), sealed); err == nil {
+		t.Errorf("expected replayed message to be rejected")
+	} else {
+		testCodes(t, err, []int{errSeal})
+	}
+	// A node that leaves and enters again cannot have its messages replayed
+	// either, because the server still remembers its sequence numbers.
+	event, _ := server.registry.member(client.node.UUID())
+	dispatch(server, &Event{Type: EventExit, Name: event.Name, Node: event.Node})
+	server.welcome(event)
+	if err := server.dispatch(client.node.UUID(), sealed); err == nil {
+		t.Errorf("expected message replayed after reentry to be rejected")
+	} else if !strings.Contains(err.Error(), "replayed") {
+		t.Errorf("expected message to be rejected as replayed: %s", err.Error())
+	}
+	sealed, _ = client.sealer.seal("stranger", server.node.UUID(), payload)
+	if err := server.dispatch("stranger", sealed); err == nil {
+		t.Errorf("expected message from stranger to be rejected")
+	} else {
+		testCodes(t, err, []int{errSeal})
+	}
+	// Even if they know where to find a service, their requests are rejected.
+	intruder.add(GROUP, &peer{
+		name:    server.node.Name(),
+		node:    server.node.UUID(),
+		service: addr,
+	})
+	intruder.Timeout = time.Millisecond * 100
+	request, _ = http.NewRequest("POST", scheme+"://"+addr+"/",
+		bytes.NewBufferString(body))
+	if _, err := intruder.Do(request); err == nil {
+		t.Errorf("expected request without the group key to be rejected")
+	} else {
+		testCodes(t, err, []int{errTimeout})
+	}
+}
+
+// callerHandler responds with the caller of a request.
+type callerHandler struct{}
+
+// ServeHTTP allows callerHandler to conform to the http.Handler interface.
+func (*callerHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	caller, _ := CallerFrom(req.Context())
+	if req.Header.Get(CallerNodeHeader) != caller.Node {
+		res.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(res).Encode(caller)
+}
+
+func TestIntegratedMemoryCaller(t *testing.T) {
+	addr := "sleuth-test-server-nineteen"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	server, _ := New(&Config{
+		group:     GROUP,
+		Handler:   new(callerHandler),
+		Service:   addr,
+		Transport: network.Transport(),
+	})
+	defer server.Close()
+	client.WaitFor(addr)
+	call := func() Caller {
+		var caller Caller
+		request, _ := http.NewRequest("GET", scheme+"://"+addr+"/", nil)
+		request.Header.Set(CallerHeader, "impostor")
+		response, err := client.Do(request)
+		if err != nil {
+			t.Errorf("client.Do failed: %s", err.Error())
+			return caller
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("expected caller header to match caller context")
+		}
+		json.NewDecoder(response.Body).Decode(&caller)
+		return caller
+	}
+	want := Caller{Name: client.node.Name(), Node: client.node.UUID()}
+	if caller := call(); caller != want {
+		t.Errorf("expected client-only caller %v, got %v", want, caller)
+	}
+	// A caller that registers a service is described by it.
+	client.Register("sleuth-test-caller", "1.2.3", new(echoHandler))
+	want.Service, want.Version = "sleuth-test-caller", "1.2.3"
+	if caller := call(); caller != want {
+		t.Errorf("expected caller %v, got %v", want, caller)
+	}
+}
+
+func TestIntegratedMemoryConcurrent(t *testing.T) {
+	addr := "sleuth-test-server-twenty"
+	network := NewMemoryNetwork()
+	client, _ := New(&Config{group: GROUP, Transport: network.Transport()})
+	defer client.Close()
+	server, _ := New(&Config{
+		group:     GROUP,
+		Handler:   new(echoHandler),
+		Service:   addr,
+		Transport: network.Transport(),
+	})
+	defer server.Close()
+	client.WaitFor(addr)
+	client.Timeout = time.Second * 10
+	httpClient := &http.Client{Transport: client}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(body string) {
+			defer wg.Done()
+			response, err := httpClient.Post(scheme+"://"+addr+"/", "text/plain",
+				bytes.NewBufferString(body))
+			if err != nil {
+				t.Errorf("http.Client.Post failed: %s", err.Error())
+				return
+			}
+			defer response.Body.Close()
+			if output, _ := ioutil.ReadAll(response.Body); string(output) != body {
+				t.Errorf("expected %s, got %s", body, string(output))
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,437 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+const (
+	// Bodies larger than chunkSize are streamed in chunks of up to chunkSize.
+	chunkSize = 32 * 1024
+	// window is the number of chunks a writer may send before the reader has
+	// consumed any of them. It bounds the memory a stream uses on either end.
+	window = 8
+)
+
+// chunk is either a piece of a streamed body (DATA) or a flow control message
+// sent by the reader of a body back to its writer (FLOW).
+type chunk struct {
+	Credit int    `json:"credit,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+	End    bool   `json:"end,omitempty"`
+	Handle string `json:"handle"`
+	Origin string `json:"origin"`
+	Reset  bool   `json:"reset,omitempty"`
+	Upload bool   `json:"upload,omitempty"`
+}
+
+func chunkMarshal(group, action string, c *chunk) []byte {
+	// This will never fail to marshal, so error can be ignored.
+	marshalled, _ := json.Marshal(c)
+	return append([]byte(group+action), zip(marshalled)...)
+}
+
+func chunkUnmarshal(p []byte) (*chunk, error) {
+	unzipped, err := unzip(p)
+	if err != nil {
+		return nil, err.(*Error).escalate(errChunkUnmarshal)
+	}
+	c := new(chunk)
+	if err = json.Unmarshal(unzipped, c); err != nil {
+		return nil, newError(errChunkUnmarshalJSON, err.Error())
+	}
+	return c, nil
+}
+
+// link identifies a streamed body and the peer at its other end. A body is
+// identified by the node that made the request, the request handle, and
+// whether it is the request body (an upload) or the response body.
+type link struct {
+	group  string
+	handle string
+	node   whisperer
+	origin string
+	peer   string
+	upload bool
+}
+
+func (l *link) key() string {
+	return streamKey(l.origin, l.handle, l.upload)
+}
+
+func (l *link) send(action string, c *chunk) error {
+	c.Handle = l.handle
+	c.Origin = l.origin
+	c.Upload = l.upload
+	return l.node.Whisper(l.peer, chunkMarshal(l.group, action, c))
+}
+
+// inbound is the reading end of a streamed body. It is the Body of a streamed
+// request on the serving peer or of a streamed response on the requester.
+type inbound struct {
+	*sync.Mutex
+	*link
+	chunks   [][]byte
+	done     chan struct{}
+	end      bool
+	err      error
+	finished bool
+	signal   chan struct{}
+	streams  *streams
+}
+
+// Close stops the stream. If the writer has not finished, it is told to stop.
+func (in *inbound) Close() error {
+	in.Lock()
+	reset := !in.end
+	in.Unlock()
+	in.finish(newError(errStreamClosed, "body is closed"), reset)
+	return nil
+}
+
+// finish ends the stream with an error that all subsequent reads return. If
+// reset is set, the writer is told to stop sending.
+func (in *inbound) finish(err error, reset bool) {
+	in.Lock()
+	if in.finished {
+		in.Unlock()
+		return
+	}
+	in.finished = true
+	in.err = err
+	if err != io.EOF {
+		in.chunks = nil
+	}
+	close(in.done)
+	in.Unlock()
+	in.streams.remove(in.key(), true)
+	in.wake()
+	if reset {
+		in.send(flow, &chunk{Reset: true})
+	}
+}
+
+func (in *inbound) push(c *chunk) {
+	in.Lock()
+	if !in.finished {
+		if len(c.Data) > 0 {
+			in.chunks = append(in.chunks, c.Data)
+		}
+		in.end = in.end || c.End
+	}
+	in.Unlock()
+	if c.Reset {
+		in.finish(newError(errStream, "body was reset by its writer"), false)
+		return
+	}
+	in.wake()
+}
+
+func (in *inbound) Read(p []byte) (int, error) {
+	for {
+		in.Lock()
+		if len(in.chunks) > 0 {
+			n := copy(p, in.chunks[0])
+			consumed := n == len(in.chunks[0])
+			if consumed {
+				in.chunks = in.chunks[1:]
+			} else {
+				in.chunks[0] = in.chunks[0][n:]
+			}
+			end := in.end
+			in.Unlock()
+			// Each consumed chunk lets the writer send another one.
+			if consumed && !end {
+				in.send(flow, &chunk{Credit: 1})
+			}
+			return n, nil
+		}
+		if in.err != nil {
+			err := in.err
+			in.Unlock()
+			return 0, err
+		}
+		if in.end {
+			in.Unlock()
+			in.finish(io.EOF, false)
+			continue
+		}
+		in.Unlock()
+		<-in.signal
+	}
+}
+
+// watch ends the stream if its context is done before the stream is.
+func (in *inbound) watch(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			err := newError(errStream, "body: %s", ctx.Err().Error())
+			err.cause = ctx.Err()
+			in.finish(err, true)
+		case <-in.done:
+		}
+	}()
+}
+
+func (in *inbound) wake() {
+	select {
+	case in.signal <- struct{}{}:
+	default:
+	}
+}
+
+// outbound is the writing end of a streamed body. It waits for credit from the
+// reader before sending each chunk so that a slow reader slows the writer down.
+type outbound struct {
+	*sync.Mutex
+	*link
+	ctx     context.Context
+	credit  int
+	err     error
+	signal  chan struct{}
+	streams *streams
+}
+
+// abort tells the reader that the body will not be completed.
+func (out *outbound) abort(err error) {
+	out.Lock()
+	if out.err == nil {
+		out.err = err
+	}
+	out.Unlock()
+	out.streams.remove(out.key(), false)
+	out.send(data, &chunk{Reset: true})
+}
+
+// failed returns the error, if any, that has stopped the stream.
+func (out *outbound) failed() error {
+	out.Lock()
+	defer out.Unlock()
+	return out.err
+}
+
+func (out *outbound) grant(c *chunk) {
+	out.Lock()
+	out.credit += c.Credit
+	if c.Reset && out.err == nil {
+		out.err = newError(errStream, "body was reset by its reader")
+	}
+	out.Unlock()
+	out.wake()
+}
+
+func (out *outbound) stop(err error) {
+	out.Lock()
+	if out.err == nil {
+		out.err = err
+	}
+	out.Unlock()
+	out.wake()
+}
+
+func (out *outbound) wake() {
+	select {
+	case out.signal <- struct{}{}:
+	default:
+	}
+}
+
+// write sends a chunk of the body, blocking until the reader has room for it.
+func (out *outbound) write(p []byte, end bool) error {
+	for len(p) > 0 {
+		out.Lock()
+		if out.err != nil {
+			err := out.err
+			out.Unlock()
+			return err
+		}
+		if out.credit > 0 {
+			out.credit--
+			out.Unlock()
+			break
+		}
+		out.Unlock()
+		select {
+		case <-out.signal:
+		case <-out.ctx.Done():
+			err := newError(errStream, "body: %s", out.ctx.Err().Error())
+			err.cause = out.ctx.Err()
+			out.abort(err)
+			return err
+		}
+	}
+	if err := out.send(data, &chunk{Data: p, End: end}); err != nil {
+		out.streams.remove(out.key(), false)
+		return newError(errStreamWhisper, err.Error())
+	}
+	if end {
+		out.streams.remove(out.key(), false)
+	}
+	return nil
+}
+
+// streams holds the bodies that are being streamed to and from a client, as
+// well as a way to cancel each request that the client is serving.
+type streams struct {
+	*sync.Mutex
+	cancels map[string]func() // keyed like the response body of a request
+	readers map[string]*inbound
+	writers map[string]*outbound
+}
+
+// cancel tells the peer serving a request that its response is unwanted.
+func (s *streams) cancel(l *link) {
+	l.send(flow, &chunk{Reset: true})
+}
+
+func (s *streams) data(from string, p []byte) error {
+	c, err := chunkUnmarshal(p)
+	if err != nil {
+		return err.(*Error).escalate(errDATA)
+	}
+	s.Lock()
+	in, ok := s.readers[streamKey(c.Origin, c.Handle, c.Upload)]
+	s.Unlock()
+	// Chunks that arrive after a reader has gone away are dropped.
+	if !ok {
+		return nil
+	}
+	if in.peer != from {
+		return newError(errDATA, "%s cannot write to stream %s", from, in.key())
+	}
+	in.push(c)
+	return nil
+}
+
+// drop ends every stream whose other end is a peer that has left.
+func (s *streams) drop(peer string) {
+	var readers []*inbound
+	var writers []*outbound
+	s.Lock()
+	for _, in := range s.readers {
+		if in.peer == peer {
+			readers = append(readers, in)
+		}
+	}
+	for _, out := range s.writers {
+		if out.peer == peer {
+			writers = append(writers, out)
+		}
+	}
+	s.Unlock()
+	for _, in := range readers {
+		in.finish(newError(errStream, "%s has left", peer), false)
+	}
+	for _, out := range writers {
+		out.stop(newError(errStream, "%s has left", peer))
+	}
+}
+
+func (s *streams) flow(from string, p []byte) error {
+	c, err := chunkUnmarshal(p)
+	if err != nil {
+		return err.(*Error).escalate(errFLOW)
+	}
+	key := streamKey(c.Origin, c.Handle, c.Upload)
+	s.Lock()
+	out, ok := s.writers[key]
+	cancel, serving := s.cancels[key]
+	s.Unlock()
+	// A requester resets the response of a request it no longer wants, which
+	// cancels the context of the handler serving that request.
+	if c.Reset && serving && c.Origin == from {
+		cancel()
+	}
+	if !ok {
+		return nil
+	}
+	if out.peer != from {
+		return newError(errFLOW, "%s cannot control stream %s", from, out.key())
+	}
+	out.grant(c)
+	return nil
+}
+
+// reader registers and returns the reading end of a streamed body. The stream
+// ends if ctx is done before the body has been read.
+func (s *streams) reader(ctx context.Context, l *link) *inbound {
+	in := &inbound{
+		Mutex:   new(sync.Mutex),
+		link:    l,
+		done:    make(chan struct{}),
+		signal:  make(chan struct{}, 1),
+		streams: s,
+	}
+	s.Lock()
+	s.readers[l.key()] = in
+	s.Unlock()
+	in.watch(ctx)
+	return in
+}
+
+func (s *streams) remove(key string, reader bool) {
+	s.Lock()
+	defer s.Unlock()
+	if reader {
+		delete(s.readers, key)
+	} else {
+		delete(s.writers, key)
+	}
+}
+
+// served forgets the cancel function of a request that has been served.
+func (s *streams) served(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.cancels, key)
+}
+
+// serving records how to cancel a request that is being served.
+func (s *streams) serving(key string, cancel func()) {
+	s.Lock()
+	defer s.Unlock()
+	s.cancels[key] = cancel
+}
+
+// writer registers and returns the writing end of a streamed body. Writes stop
+// if ctx is done before the body has been written.
+func (s *streams) writer(ctx context.Context, l *link) *outbound {
+	out := &outbound{
+		Mutex:   new(sync.Mutex),
+		link:    l,
+		ctx:     ctx,
+		credit:  window,
+		signal:  make(chan struct{}, 1),
+		streams: s,
+	}
+	s.Lock()
+	s.writers[l.key()] = out
+	s.Unlock()
+	return out
+}
+
+func newStreams() *streams {
+	return &streams{
+		Mutex:   new(sync.Mutex),
+		cancels: make(map[string]func()),
+		readers: make(map[string]*inbound),
+		writers: make(map[string]*outbound),
+	}
+}
+
+func streamKey(origin, handle string, upload bool) string {
+	if upload {
+		return origin + "/" + handle + "/upload"
+	}
+	return origin + "/" + handle
+}
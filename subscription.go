@@ -0,0 +1,150 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ChangeType is the kind of change in the membership of a sleuth network.
+type ChangeType int
+
+// The kinds of membership changes a Subscription delivers.
+const (
+	// PeerJoined means that a peer offering a service has been found.
+	PeerJoined ChangeType = iota + 1
+	// PeerLeft means that a peer offering a service has left the network.
+	PeerLeft
+	// ServiceAvailable means that the first peer offering a service has been
+	// found. It follows the PeerJoined change of that peer.
+	ServiceAvailable
+	// ServiceUnavailable means that the last peer offering a service has left
+	// the network. It follows the PeerLeft change of that peer.
+	ServiceUnavailable
+)
+
+// buffer is the number of changes a subscription holds before it drops them.
+const buffer = 64
+
+func (t ChangeType) String() string {
+	switch t {
+	case PeerJoined:
+		return "peer joined"
+	case PeerLeft:
+		return "peer left"
+	case ServiceAvailable:
+		return "service available"
+	case ServiceUnavailable:
+		return "service unavailable"
+	default:
+		return "unknown"
+	}
+}
+
+// Change is a change in the membership of a sleuth network.
+type Change struct {
+	// Peer is the peer that joined or left.
+	Peer PeerInfo
+	// Service is the service the peer offers.
+	Service string
+	// Type is the kind of change.
+	Type ChangeType
+}
+
+// Subscription delivers the membership changes of a sleuth network. Changes
+// are buffered, and if a subscriber falls too far behind, new changes are
+// dropped instead of blocking the client.
+type Subscription struct {
+	changes     chan Change
+	dropped     uint64
+	services    map[string]struct{}
+	subscribers *subscribers
+}
+
+// Changes returns the channel that changes are delivered on. It is closed when
+// the subscription or its client is closed.
+func (s *Subscription) Changes() <-chan Change {
+	return s.changes
+}
+
+// Close stops the delivery of changes and closes the Changes channel.
+func (s *Subscription) Close() {
+	s.subscribers.remove(s)
+}
+
+// Dropped returns the number of changes that were dropped because the Changes
+// channel was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) deliver(change Change) {
+	if s.services != nil {
+		if _, ok := s.services[change.Service]; !ok {
+			return
+		}
+	}
+	select {
+	case s.changes <- change:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// subscribers holds the subscriptions of a client.
+type subscribers struct {
+	*sync.Mutex
+	closed bool
+	list   map[*Subscription]struct{}
+}
+
+// add registers a subscription, or closes it if the client is closed.
+func (s *subscribers) add(subscription *Subscription) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		close(subscription.changes)
+		return
+	}
+	s.list[subscription] = struct{}{}
+}
+
+// close closes every subscription and any that are added later.
+func (s *subscribers) close() {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	for subscription := range s.list {
+		close(subscription.changes)
+		delete(s.list, subscription)
+	}
+}
+
+func (s *subscribers) publish(changes ...Change) {
+	s.Lock()
+	defer s.Unlock()
+	for subscription := range s.list {
+		for _, change := range changes {
+			subscription.deliver(change)
+		}
+	}
+}
+
+func (s *subscribers) remove(subscription *Subscription) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.list[subscription]; ok {
+		close(subscription.changes)
+		delete(s.list, subscription)
+	}
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{
+		Mutex: new(sync.Mutex),
+		list:  make(map[*Subscription]struct{}),
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import "sync"
+
+// EventType identifies the kind of an Event emitted by a Transport.
+type EventType int
+
+const (
+	// EventEnter is emitted when a peer is discovered.
+	EventEnter EventType = iota + 1
+	// EventExit is emitted when a peer leaves the group or disappears.
+	EventExit
+	// EventWhisper is emitted when a peer sends a message to this node.
+	EventWhisper
+)
+
+// Event is a membership change or an incoming message on a Transport.
+type Event struct {
+	// Type is the kind of event.
+	Type EventType
+	// Name is the short public name of the peer that caused the event.
+	Name string
+	// Node is the identifier of the peer that caused the event. It is the
+	// address used to whisper to that peer.
+	Node string
+	// Headers holds the headers a peer announced when it entered.
+	Headers map[string]string
+	// Msg is the payload of a whisper.
+	Msg []byte
+}
+
+// Transport is the network layer sleuth peers use to find one another and to
+// exchange messages. Headers are set before a transport is started and are
+// delivered to peers in the EventEnter event when they discover this node.
+type Transport interface {
+	// Events returns the stream of events for this node. It is closed when the
+	// transport stops.
+	Events() <-chan *Event
+	// Join makes this node a member of a group.
+	Join(group string) error
+	// Leave removes this node from a group.
+	Leave(group string) error
+	// Name returns the short public name of this node.
+	Name() string
+	// SetHeader sets a header that is announced to peers.
+	SetHeader(name, value string) error
+	// Start begins discovery of and by other nodes.
+	Start() error
+	// Stop leaves the network and closes the event stream.
+	Stop() error
+	// UUID returns the identifier peers use to whisper to this node.
+	UUID() string
+	// Whisper sends a message to a single peer.
+	Whisper(node string, payload []byte) error
+}
+
+// eventQueue is an unbounded queue that delivers events in order, so that a
+// transport never blocks on a consumer that is busy with an earlier event.
+type eventQueue struct {
+	cond    *sync.Cond
+	queue   []*Event
+	stopped bool
+	stream  chan *Event
+}
+
+// pump delivers queued events until the queue is stopped.
+func (q *eventQueue) pump() {
+	defer close(q.stream)
+	for {
+		q.cond.L.Lock()
+		for len(q.queue) == 0 && !q.stopped {
+			q.cond.Wait()
+		}
+		if q.stopped {
+			q.cond.L.Unlock()
+			return
+		}
+		event := q.queue[0]
+		q.queue = q.queue[1:]
+		q.cond.L.Unlock()
+		q.stream <- event
+	}
+}
+
+func (q *eventQueue) push(event *Event) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.queue = append(q.queue, event)
+	q.cond.Signal()
+}
+
+func (q *eventQueue) stop() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.stopped = true
+	q.cond.Signal()
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{
+		cond:   sync.NewCond(new(sync.Mutex)),
+		stream: make(chan *Event),
+	}
+}
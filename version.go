@@ -0,0 +1,191 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import (
+	"strconv"
+	"strings"
+)
+
+// VersionHeader holds the semantic version constraint that a peer's service
+// version must satisfy for the peer to receive a request, e.g., ">=2.1 <3".
+// Peers whose version is missing or is not a semantic version never satisfy a
+// constraint. The same constraints can be passed to WaitFor after an "@", e.g.:
+// 	client.WaitFor("user-service@>=2.1 <3")
+// A constraint is a list of comparisons that must all hold. Alternatives are
+// separated by "||". The comparison operators are =, !=, >, >=, <, <=, ~ (the
+// same minor version), and ^ (the same major version). A version with no
+// operator, or with missing parts, matches every version it is a prefix of:
+// "2.1" matches 2.1.0 and 2.1.7 but not 2.2.0.
+const VersionHeader = "X-Sleuth-Version"
+
+// comparison is a single comparison with a version, e.g., ">=2.1.0".
+type comparison struct {
+	operator string
+	version  *semver
+}
+
+// constraint is a list of alternatives, each of which is a list of comparisons
+// that must all hold. A nil constraint matches every peer.
+type constraint [][]comparison
+
+func (c constraint) match(version string) bool {
+	if c == nil {
+		return true
+	}
+	v, _, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+	for _, alternative := range c {
+		matched := true
+		for _, comparison := range alternative {
+			if !comparison.match(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (c comparison) match(v *semver) bool {
+	result := v.compare(c.version)
+	switch c.operator {
+	case "!=":
+		return result != 0
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	default:
+		return result == 0
+	}
+}
+
+// semver is a semantic version. Build metadata is ignored.
+type semver struct {
+	major      int
+	minor      int
+	patch      int
+	prerelease string
+}
+
+// compare returns -1, 0, or 1 if v is less than, equal to, or greater than w.
+// A prerelease version is less than the same version without a prerelease.
+func (v *semver) compare(w *semver) int {
+	for _, pair := range [...][2]int{
+		{v.major, w.major}, {v.minor, w.minor}, {v.patch, w.patch}} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case v.prerelease == w.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case w.prerelease == "":
+		return -1
+	case v.prerelease < w.prerelease:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// bounds returns the comparisons that a range operator (or none) stands for.
+func bounds(operator string, v *semver, parts int) []comparison {
+	upper := &semver{major: v.major + 1}
+	switch {
+	case operator == "^" && v.major == 0 && v.minor == 0 && parts == 3:
+		upper = &semver{patch: v.patch + 1}
+	case operator == "^" && v.major == 0 && parts > 1:
+		upper = &semver{minor: v.minor + 1}
+	case operator == "^":
+		// The upper bound is the next major version.
+	case parts == 3 && operator != "~":
+		return []comparison{{operator: "=", version: v}}
+	case parts > 1:
+		upper = &semver{major: v.major, minor: v.minor + 1}
+	}
+	return []comparison{
+		{operator: ">=", version: v}, {operator: "<", version: upper}}
+}
+
+func parseConstraint(value string) (constraint, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	var c constraint
+	for _, alternative := range strings.Split(value, "||") {
+		var comparisons []comparison
+		fields := strings.Fields(alternative)
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			// Allow whitespace between an operator and its version.
+			if strings.Trim(field, "<>=!~^") == "" && i+1 < len(fields) {
+				i++
+				field += fields[i]
+			}
+			if field == "*" || field == "x" {
+				continue
+			}
+			operator := field[:len(field)-len(strings.TrimLeft(field, "<>=!~^"))]
+			v, parts, ok := parseVersion(field[len(operator):])
+			if !ok {
+				return nil, newError(errVersion, "%s is an invalid version", field)
+			}
+			switch operator {
+			case "", "=", "~", "^":
+				comparisons = append(comparisons, bounds(operator, v, parts)...)
+			case "!=", "<", "<=", ">", ">=":
+				comparisons = append(comparisons,
+					comparison{operator: operator, version: v})
+			default:
+				return nil, newError(errVersion, "%s is an invalid operator", operator)
+			}
+		}
+		c = append(c, comparisons)
+	}
+	return c, nil
+}
+
+// parseVersion parses a full or partial semantic version, with or without a
+// leading "v", and returns the number of version parts it contains.
+func parseVersion(value string) (*semver, int, bool) {
+	value = strings.TrimPrefix(value, "v")
+	if i := strings.IndexByte(value, '+'); i >= 0 {
+		value = value[:i]
+	}
+	v := new(semver)
+	if i := strings.IndexByte(value, '-'); i >= 0 {
+		value, v.prerelease = value[:i], value[i+1:]
+	}
+	parts := strings.Split(value, ".")
+	if len(parts) > 3 {
+		return nil, 0, false
+	}
+	numbers := [...]*int{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return nil, 0, false
+		}
+		*numbers[i] = number
+	}
+	return v, len(parts), true
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Afshin Darian. All rights reserved.
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package sleuth
+
+import "sync"
+
+// work counts the requests a client is serving or sending so that Shutdown
+// can wait for them to finish. Unlike a sync.WaitGroup, it can be waited on
+// while new requests are still arriving.
+type work struct {
+	*sync.Mutex
+	count int
+	idle  chan struct{} // closed whenever count is zero
+}
+
+func (w *work) add() {
+	w.Lock()
+	defer w.Unlock()
+	if w.count == 0 {
+		w.idle = make(chan struct{})
+	}
+	w.count++
+}
+
+func (w *work) done() {
+	w.Lock()
+	defer w.Unlock()
+	if w.count--; w.count == 0 {
+		close(w.idle)
+	}
+}
+
+func (w *work) outstanding() int {
+	w.Lock()
+	defer w.Unlock()
+	return w.count
+}
+
+// wait returns a channel that is closed once no requests are outstanding.
+func (w *work) wait() <-chan struct{} {
+	w.Lock()
+	defer w.Unlock()
+	return w.idle
+}
+
+func newWork() *work {
+	idle := make(chan struct{})
+	close(idle)
+	return &work{Mutex: new(sync.Mutex), idle: idle}
+}
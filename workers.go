@@ -4,7 +4,10 @@
 
 package sleuth
 
-import "sync"
+import (
+	"math/rand"
+	"sync"
+)
 
 type workers struct {
 	*sync.Mutex
@@ -24,26 +27,86 @@ func (w *workers) add(p *peer) int {
 	return len(w.list)
 }
 
+// all returns a copy of the list of workers.
+func (w *workers) all() []*peer {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	return append([]*peer(nil), w.list...)
+}
+
 func (w *workers) available() bool {
 	w.Mutex.Lock()
 	defer w.Mutex.Unlock()
 	return len(w.list) > 0
 }
 
+// count returns the number of workers whose versions satisfy a constraint.
+func (w *workers) count(want constraint) int {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	count := 0
+	for _, p := range w.list {
+		if want.match(p.version) {
+			count++
+		}
+	}
+	return count
+}
+
+// find returns the worker with a name, if there is one.
+func (w *workers) find(name string) (*peer, bool) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	for _, p := range w.list {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
 func (w *workers) next() *peer {
 	w.Mutex.Lock()
 	defer w.Mutex.Unlock()
-	length := len(w.list)
-	current := w.current
-	if length == 0 {
+	return w.rotate(w.list)
+}
+
+// pick chooses an eligible peer using a load-balancing strategy. If eligible
+// is nil, every peer is eligible. The key is only used by the ConsistentHash
+// strategy, and load returns the number of outstanding requests to a peer.
+func (w *workers) pick(strategy, key string, eligible func(*peer) bool,
+	load func(string) int) *peer {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	list := w.list
+	if eligible != nil {
+		list = nil
+		for _, p := range w.list {
+			if eligible(p) {
+				list = append(list, p)
+			}
+		}
+	}
+	if len(list) == 0 {
 		return nil
 	}
-	if current < length {
-		w.current++
-		return w.list[current]
+	switch strategy {
+	case ConsistentHash:
+		if key != "" {
+			return hashed(list, key)
+		}
+	case LeastOutstanding:
+		index := least(list, w.current, load)
+		w.current = index + 1
+		return list[index]
+	case PowerOfTwo:
+		return twoChoices(list, load)
+	case Random:
+		return list[rand.Intn(len(list))]
+	case Weighted:
+		return weighted(list)
 	}
-	w.current = 1
-	return w.list[0]
+	return w.rotate(list)
 }
 
 func (w *workers) remove(name string) (int, *peer) {
@@ -58,6 +121,20 @@ func (w *workers) remove(name string) (int, *peer) {
 	return len(w.list), nil
 }
 
+func (w *workers) rotate(list []*peer) *peer {
+	length := len(list)
+	current := w.current
+	if length == 0 {
+		return nil
+	}
+	if current < length {
+		w.current++
+		return list[current]
+	}
+	w.current = 1
+	return list[0]
+}
+
 func newWorkers() *workers {
 	return &workers{
 		Mutex: new(sync.Mutex),
@@ -4,52 +4,156 @@
 
 package sleuth
 
-import "net/http"
+import (
+	"bytes"
+	"context"
+	"net/http"
+)
 
 type whisperer interface {
 	Whisper(addr string, payload []byte) error
 }
 
+// writer buffers a response until it is closed. If the response body grows
+// larger than a chunk, the response is sent and its body is streamed instead.
+// As with net/http, the status code and headers are fixed by the first call to
+// WriteHeader or Write; later changes to the header map are not sent.
 type writer struct {
 	http.ResponseWriter
+	buffer    *bytes.Buffer
+	ctx       context.Context
+	dest      *destination
 	group     string
+	header    http.Header
 	output    *response
 	peer      string
+	stream    *outbound
+	streams   *streams
 	whisperer whisperer
 }
 
-func (w *writer) Header() http.Header {
-	return w.output.Header
+// close sends whatever remains of the response. It is called once the handler
+// has returned, so a handler that never wrote anything still sends a response.
+func (w *writer) close() error {
+	if w.stream != nil {
+		return w.stream.write(w.buffer.Bytes(), true)
+	}
+	if w.output.Code == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.output.Body = w.buffer.Bytes()
+	return w.send()
 }
 
-func (w *writer) Write(data []byte) (int, error) {
+// Flush sends the response written so far without waiting for the handler to
+// return and allows writer to conform to the http.Flusher interface. Once a
+// response has been flushed, its body is streamed, so the caller can read each
+// flushed piece (e.g., a server-sent event) as soon as it arrives.
+func (w *writer) Flush() {
 	if w.output.Code == 0 {
 		w.WriteHeader(http.StatusOK)
 	}
-	header := w.Header()
-	if header.Get("Content-Type") == "" {
-		header.Add("Content-Type", http.DetectContentType(data))
+	// Errors surface in the next call to Write.
+	w.flush(true)
+}
+
+// flush starts streaming the response body, if it has not already started, and
+// sends every complete chunk in the buffer, or everything in it if all is set.
+func (w *writer) flush(all bool) error {
+	if w.stream == nil {
+		w.stream = w.streams.writer(w.ctx, &link{
+			group:  w.group,
+			handle: w.dest.handle,
+			node:   w.whisperer,
+			origin: w.dest.node,
+			peer:   w.peer,
+		})
+		w.output.Stream = true
+		if err := w.send(); err != nil {
+			w.streams.remove(w.stream.key(), false)
+			return err
+		}
+	}
+	for w.buffer.Len() >= chunkSize || all && w.buffer.Len() > 0 {
+		if err := w.stream.write(w.buffer.Next(chunkSize), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *writer) Header() http.Header {
+	return w.header
+}
+
+func (w *writer) send() error {
+	// Like net/http, sniff the content type from the start of the body.
+	if w.buffer.Len() > 0 && w.output.Header.Get("Content-Type") == "" {
+		w.output.Header.Set("Content-Type", http.DetectContentType(w.buffer.Bytes()))
 	}
-	w.output.Body = data
 	payload := resMarshal(w.group, w.output)
 	if err := w.whisperer.Whisper(w.peer, payload); err != nil {
-		return 0, newError(errResWhisper, err.Error())
+		return newError(errResWhisper, err.Error())
+	}
+	return nil
+}
+
+func (w *writer) Write(data []byte) (int, error) {
+	if w.output.Code == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !bodyAllowed(w.output.Code) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if w.stream != nil {
+		if err := w.stream.failed(); err != nil {
+			return 0, err
+		}
+	}
+	w.buffer.Write(data)
+	if w.buffer.Len() >= chunkSize {
+		if err := w.flush(false); err != nil {
+			return 0, err
+		}
 	}
 	return len(data), nil
 }
 
 func (w *writer) WriteHeader(code int) {
+	// Only the first call has any effect.
+	if w.output.Code != 0 {
+		return
+	}
 	w.output.Code = code
+	for key, values := range w.header {
+		w.output.Header[key] = append([]string(nil), values...)
+	}
+}
+
+// bodyAllowed reports whether a response with a status code may have a body.
+func bodyAllowed(code int) bool {
+	switch {
+	case code >= 100 && code <= 199:
+		return false
+	case code == http.StatusNoContent, code == http.StatusNotModified:
+		return false
+	}
+	return true
 }
 
-func newWriter(node whisperer, dest *destination) *writer {
+func newWriter(ctx context.Context, node whisperer, dest *destination, streams *streams) *writer {
 	return &writer{
-		group: dest.group,
+		buffer: new(bytes.Buffer),
+		ctx:    ctx,
+		dest:   dest,
+		group:  dest.group,
+		header: http.Header(make(map[string][]string)),
 		output: &response{
 			Handle: dest.handle,
 			Header: http.Header(make(map[string][]string)),
 		},
 		peer:      dest.node,
+		streams:   streams,
 		whisperer: node,
 	}
 }